@@ -0,0 +1,171 @@
+package sgreader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Versions of the test files built by buildSG
+const (
+	versionSG2 uint32 = 0xd3
+	versionSG3 uint32 = 0xd6
+)
+
+// Builds an sg file holding the given bitmap and image records. The image
+// records are written after the reserved record, without the alpha fields
+// for versions before 0xd6.
+func buildSG(t testing.TB, version uint32, bitmaps []SgBitmapRecord, images []SgImageRecord) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	header := SgHeader{
+		Version:                       version,
+		NumImageRecords:               int32(len(images)),
+		NumBitmapRecords:              int32(len(bitmaps)),
+		NumBitmapRecordsWithoutSystem: int32(len(bitmaps)),
+	}
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.Write(make([]byte, headerSize-buf.Len()))
+
+	maxBitmaps := 200
+	if version == versionSG2 {
+		maxBitmaps = 100
+	}
+	for _, bitmap := range bitmaps {
+		binary.Write(&buf, binary.LittleEndian, bitmap)
+	}
+	buf.Write(make([]byte, max(0, maxBitmaps-len(bitmaps))*recordSize))
+
+	for _, image := range append([]SgImageRecord{{}}, images...) {
+		if version >= 0xd6 {
+			binary.Write(&buf, binary.LittleEndian, image)
+			continue
+		}
+		binary.Write(&buf, binary.LittleEndian, SgImageRecordNonAlpha{
+			Offset:             image.Offset,
+			Length:             image.Length,
+			UncompressedLength: image.UncompressedLength,
+			InvertOffset:       image.InvertOffset,
+			Width:              image.Width,
+			Height:             image.Height,
+			Type:               image.Type,
+			Flags:              image.Flags,
+			BitmapId:           image.BitmapId,
+		})
+	}
+
+	data := buf.Bytes()
+	// Sg2 files are recognised by the file size stored in the header, sg3
+	// files by it matching the actual size
+	size := uint32(len(data))
+	if version == versionSG2 {
+		size = 74480
+	}
+	binary.LittleEndian.PutUint32(data, size)
+	return data
+}
+
+// Builds a bitmap record whose images have the global ids start to end
+func bitmapRecord(name string, start, end uint32) SgBitmapRecord {
+	record := SgBitmapRecord{StartIndex: start, EndIndex: end, NumImages: end - start + 1}
+	copy(record.Filename[:], name)
+	return record
+}
+
+// Encodes the pixels as little endian 555 values, as stored for plain
+// images
+func plainData(pixels ...uint16) []byte {
+	data := make([]byte, 2*len(pixels))
+	for i, c := range pixels {
+		binary.LittleEndian.PutUint16(data[2*i:], c)
+	}
+	return data
+}
+
+// Loads an sg3 file named test.sg3 from memory, with data as its test.555
+func loadFixture(t testing.TB, bitmaps []SgBitmapRecord, images []SgImageRecord, data []byte) *SgFile {
+	t.Helper()
+	sgFile, err := ReadMemory(buildSG(t, versionSG3, bitmaps, images), map[string][]byte{"test.555": data}, "test.sg3")
+	if err != nil {
+		t.Fatalf("Unable to load fixture: %v", err)
+	}
+	return sgFile
+}
+
+// The sample file holds a bitmap "sample" with a 2x2 plain image of red,
+// green, blue and white pixels, followed by a 3x2 sprite whose first row
+// has 2 pixels after a transparent one and whose second row has a single
+// white pixel after a transparent one
+func sampleFixture(t testing.TB) *SgFile {
+	t.Helper()
+	data := plainData(0x7c00, 0x03e0, 0x001f, 0x7fff)
+	spriteOffset := len(data)
+	data = append(data, 255, 1, 2)
+	data = append(data, plainData(0x1234, 0x4321)...)
+	data = append(data, 255, 1, 1)
+	data = append(data, plainData(0x7fff)...)
+
+	images := []SgImageRecord{
+		{Offset: 0, Length: 8, Width: 2, Height: 2, Type: uint16(TypePlain)},
+		{Offset: uint32(spriteOffset), Length: uint32(len(data) - spriteOffset), Width: 3, Height: 2, Type: uint16(TypeSprite)},
+	}
+	return loadFixture(t, []SgBitmapRecord{bitmapRecord("Sample.bmp", 1, 2)}, images, data)
+}
+
+// The alpha fixture holds a 2x2 sprite with an alpha mask: a red pixel at
+// alpha 0x84 and an opaque white pixel in the first row, and a transparent
+// pixel followed by a blue one at alpha 0x84 in the second row
+func alphaFixture(t testing.TB) *SgFile {
+	t.Helper()
+	data := []byte{2}
+	data = append(data, plainData(0x7c00, 0x7fff)...)
+	data = append(data, 255, 1, 1)
+	data = append(data, plainData(0x001f)...)
+	length := len(data)
+	// Each alpha value takes two bytes, only the first of which is used
+	data = append(data, 2, 0x10, 0, 0x1f, 0, 255, 1, 1, 0x10, 0)
+
+	images := []SgImageRecord{{Length: uint32(length), AlphaLength: uint32(len(data) - length), Width: 2, Height: 2, Type: uint16(TypeSprite)}}
+	return loadFixture(t, []SgBitmapRecord{bitmapRecord("Alpha.bmp", 1, 1)}, images, data)
+}
+
+// Decodes the image or fails the test
+func mustDecode(t testing.TB, sgImage *SgImage) []byte {
+	t.Helper()
+	img, err := sgImage.GetImage()
+	if err != nil {
+		t.Fatalf("Unable to decode image %d: %v", sgImage.ImageId(), err)
+	}
+	return img.Pix
+}
+
+// Loads a file with a square image of each of the given sizes in bitmap
+// "many", alternating between plain images and sprites whose rows start
+// with a transparent pixel. Every pixel is opaque or fully transparent, so
+// the images survive a round trip through PNG unchanged.
+func manyFixture(tb testing.TB, sizes []int) *SgFile {
+	tb.Helper()
+	var images []SgImageRecord
+	var data []byte
+	for i, size := range sizes {
+		offset := len(data)
+		record := SgImageRecord{Offset: uint32(offset), Width: int16(size), Height: int16(size), Type: uint16(TypePlain)}
+		if i%2 == 1 && size >= 2 {
+			record.Type = uint16(TypeSprite)
+		}
+		for y := 0; y < size; y++ {
+			row := make([]uint16, size)
+			for x := range row {
+				row[x] = uint16(i*31+y*7+x) & 0x7fff
+			}
+			if record.Type == uint16(TypeSprite) {
+				data = append(data, 255, 1, byte(size-1))
+				row = row[1:]
+			}
+			data = append(data, plainData(row...)...)
+		}
+		record.Length = uint32(len(data) - offset)
+		images = append(images, record)
+	}
+	return loadFixture(tb, []SgBitmapRecord{bitmapRecord("many.bmp", 1, uint32(len(sizes)))}, images, data)
+}
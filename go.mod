@@ -0,0 +1,3 @@
+module github.com/TheOnly92/sgreader
+
+go 1.23
@@ -10,10 +10,14 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/draw"
 	"io"
+	"iter"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"unicode"
 )
 
 const (
@@ -44,23 +48,27 @@ func newBitmapRecord(r io.Reader) (*SgBitmapRecord, error) {
 
 // SgBitmap stores references to a series of images
 type SgBitmap struct {
-	images     []*SgImage
-	record     *SgBitmapRecord
-	file       *os.File
-	sgFilename string
-	bitmapId   int
-	isExtern   bool
+	images   []*SgImage
+	record   *SgBitmapRecord
+	sgFile   *SgFile
+	dataName string
+	bitmapId int
+	// Set while the images of the bitmap haven't been read yet, see
+	// ReadFileLazy
+	pending bool
+	// Why the images of a lazily loaded bitmap couldn't be read
+	loadErr error
 }
 
-func newSgBitmap(id int, sgFilename string, r io.Reader) (*SgBitmap, error) {
+func newSgBitmap(id int, sgFile *SgFile, r io.Reader) (*SgBitmap, error) {
 	record, err := newBitmapRecord(r)
 	if err != nil {
 		return nil, err
 	}
 	return &SgBitmap{
-		bitmapId:   id,
-		sgFilename: sgFilename,
-		record:     record,
+		bitmapId: id,
+		sgFile:   sgFile,
+		record:   record,
 	}, nil
 }
 
@@ -69,19 +77,157 @@ func (sgBitmap *SgBitmap) ImageCount() int {
 	return len(sgBitmap.images)
 }
 
+// The number of bytes the images of this bitmap take up in the .555 files
+func (sgBitmap *SgBitmap) TotalStorageSize() int {
+	total := 0
+	for _, image := range sgBitmap.images {
+		total += image.StorageSize()
+	}
+	return total
+}
+
+// The size of the source bitmap the images were cut from, as stored in the
+// bitmap record. This is unrelated to the sizes of the individual images.
+func (sgBitmap *SgBitmap) Dimensions() (w, h int) {
+	return int(sgBitmap.record.Width), int(sgBitmap.record.Height)
+}
+
 // Name of the bitmap along with the number of images
 func (sgBitmap *SgBitmap) String() string {
 	return fmt.Sprintf("%s (%d)", sgBitmap.record.filenameString(), len(sgBitmap.images))
 }
 
+// The file name of the bitmap exactly as stored in its record, including
+// the extension
+func (sgBitmap *SgBitmap) FileName() string {
+	return sgBitmap.record.filenameString()
+}
+
 // The name of the bitmap without the extension ".bmp"
 func (sgBitmap *SgBitmap) BitmapName() string {
 	filename := strings.ToLower(sgBitmap.record.filenameString())
 	return strings.Replace(filename, ".bmp", "", -1)
 }
 
+// Creates the directory under root that holds the images of this bitmap when
+// extracting each bitmap into its own folder, and returns its path
+func (sgBitmap *SgBitmap) OutputDir(root string) (string, error) {
+	dir := filepath.Join(root, sgBitmap.dirName())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// The bitmap name made safe to use as a single directory name
+func (sgBitmap *SgBitmap) dirName() string {
+	name := sgBitmap.BitmapName()
+	if name == "" {
+		return fmt.Sprintf("bitmap_%d", sgBitmap.bitmapId)
+	}
+	return SanitizeName(name)
+}
+
+// Returns name with characters that aren't allowed in file names on common
+// filesystems (path separators, control characters, spaces and
+// <>:"|?*) replaced by underscores, so it can be used as a single path
+// component
+func SanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || unicode.IsSpace(r) || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	// Windows doesn't allow names ending in a dot
+	name = strings.TrimRight(name, ".")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// The system bitmap holds the user interface images shared by the game
+// files rather than content of this file
+func (sgBitmap *SgBitmap) isSystem() bool {
+	return sgBitmap.BitmapName() == "system"
+}
+
+// Check the images of the bitmap against the bitmap record and return a
+// warning for each inconsistency found. These usually mean the file was
+// parsed at the wrong offsets.
+func (sgBitmap *SgBitmap) Verify() []string {
+	var warnings []string
+	width, height := int(sgBitmap.record.Width), int(sgBitmap.record.Height)
+	for _, image := range sgBitmap.images {
+		imageWidth, imageHeight := int(image.workRecord.Width), int(image.workRecord.Height)
+		if width > 0 && height > 0 && (imageWidth > width || imageHeight > height) {
+			warnings = append(warnings, fmt.Sprintf("%s: image %d (%dx%d) is larger than the bitmap (%dx%d)",
+				sgBitmap.BitmapName(), image.localIndex, imageWidth, imageHeight, width, height))
+		}
+	}
+
+	if int(sgBitmap.record.NumImages) != len(sgBitmap.images) {
+		warnings = append(warnings, fmt.Sprintf("%s: record declares %d images but %d are attached",
+			sgBitmap.BitmapName(), sgBitmap.record.NumImages, len(sgBitmap.images)))
+	}
+	if warning := sgBitmap.checkGlobalRange(); warning != "" {
+		warnings = append(warnings, warning)
+	}
+	return warnings
+}
+
+// Get the range of global image ids the bitmap record claims for the
+// bitmap. Images are attached by the bitmap id in their own record, so the
+// images of the bitmap may not match this range in a corrupt file, which
+// Verify reports.
+func (sgBitmap *SgBitmap) GlobalRange() (start, end uint32) {
+	return sgBitmap.record.StartIndex, sgBitmap.record.EndIndex
+}
+
+// Returns a warning if the attached images fall outside GlobalRange
+func (sgBitmap *SgBitmap) checkGlobalRange() string {
+	if len(sgBitmap.images) == 0 {
+		return ""
+	}
+	first, last := sgBitmap.images[0].imageId, sgBitmap.images[len(sgBitmap.images)-1].imageId
+	start, end := sgBitmap.GlobalRange()
+	if first < int(start) || last > int(end) {
+		return fmt.Sprintf("%s: image ids %d-%d are outside the record range %d-%d",
+			sgBitmap.BitmapName(), first, last, start, end)
+	}
+	return ""
+}
+
+// Reports whether any image of the bitmap takes its data from the external
+// .555 file named by the bitmap record rather than the .555 file of the sg
+// file
+func (sgBitmap *SgBitmap) UsesExternalData() bool {
+	for _, image := range sgBitmap.images {
+		if image.IsExternal() {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the bitmap has images in both the external .555 file and
+// the .555 file of the sg file
+func (sgBitmap *SgBitmap) MixedData() bool {
+	external, internal := false, false
+	for _, image := range sgBitmap.images {
+		if image.IsExternal() {
+			external = true
+		} else {
+			internal = true
+		}
+	}
+	return external && internal
+}
+
 // Add an image to the bitmap
 func (sgBitmap *SgBitmap) AddImage(child *SgImage) {
+	child.localIndex = len(sgBitmap.images)
 	sgBitmap.images = append(sgBitmap.images, child)
 }
 
@@ -93,80 +239,195 @@ func (sgBitmap *SgBitmap) Image(id int) *SgImage {
 	return sgBitmap.images[id]
 }
 
+// Iterate over the images of the bitmap with their local index, in the order
+// of the image records in the file
+func (sgBitmap *SgBitmap) Images() iter.Seq2[int, *SgImage] {
+	return func(yield func(int, *SgImage) bool) {
+		for i, image := range sgBitmap.images {
+			if !yield(i, image) {
+				return
+			}
+		}
+	}
+}
+
+// Get the images of the bitmap from local index start up to, but not
+// including, end
+func (sgBitmap *SgBitmap) ImageRange(start, end int) ([]*SgImage, error) {
+	if start < 0 || start > end || end > len(sgBitmap.images) {
+		return nil, fmt.Errorf("Image range %d:%d out of bounds (%d images)", start, end, len(sgBitmap.images))
+	}
+	return append([]*SgImage(nil), sgBitmap.images[start:end]...), nil
+}
+
+// Get the pairs of local indices where the second image is the mirrored
+// version of the first, so only the originals need to be stored
+func (sgBitmap *SgBitmap) MirrorPairs() [][2]int {
+	var pairs [][2]int
+	for _, image := range sgBitmap.images {
+		source := image.invertSource
+		if source != nil && source.parent == sgBitmap {
+			pairs = append(pairs, [2]int{source.localIndex, image.localIndex})
+		}
+	}
+	return pairs
+}
+
+// Returns the error that prevented the images of the bitmap from being
+// read, for files opened by ReadFileLazy. The bitmap has no images then.
+func (sgBitmap *SgBitmap) Err() error {
+	return sgBitmap.loadErr
+}
+
 // Get an image.RGBA object from the bitmap by the id
 func (sgBitmap *SgBitmap) GetImage(id int) (*image.RGBA, error) {
+	if sgBitmap.loadErr != nil {
+		return nil, sgBitmap.loadErr
+	}
 	if id < 0 || id >= len(sgBitmap.images) {
 		return nil, errors.New("Id out of bounds")
 	}
 	return sgBitmap.images[id].GetImage()
 }
 
-// Opens the appropriate .555 file to extract data, returns os.File object
-func (sgBitmap *SgBitmap) OpenFile(isExtern bool) (*os.File, error) {
-	if sgBitmap.file != nil && sgBitmap.isExtern != isExtern {
-		sgBitmap.file.Close()
-		sgBitmap.file = nil
+// Draws the isometric images at the given local indices onto one image,
+// laid out on a diamond grid cols tiles wide the way the game lays out map
+// tiles: the next column is half a tile to the right and down, the next row
+// half a tile to the left and down. The grid is sized by the footprint of
+// the first image, and images taller than their footprint, such as
+// buildings, extend upwards from it.
+func (sgBitmap *SgBitmap) IsometricComposite(indices []int, cols int) (*image.RGBA, error) {
+	if len(indices) == 0 || cols <= 0 {
+		return nil, fmt.Errorf("Invalid grid of %d images in %d columns", len(indices), cols)
 	}
-	sgBitmap.isExtern = isExtern
-	if sgBitmap.file == nil {
-		filename, err := sgBitmap.find555File()
-		if err != nil {
-			return nil, err
+	tiles := make([]*image.RGBA, len(indices))
+	for i, index := range indices {
+		sgImage := sgBitmap.Image(index)
+		if sgImage == nil {
+			return nil, fmt.Errorf("Image %d out of bounds", index)
 		}
-
-		file, err := os.Open(filename)
+		if sgImage.Type() != TypeIsometric {
+			return nil, fmt.Errorf("Image %d is not isometric: %s", index, sgImage.Type())
+		}
+		img, err := sgImage.GetImage()
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Image %d: %w", index, err)
 		}
-		sgBitmap.file = file
+		tiles[i] = img
+	}
+
+	// Tiles are drawn 2 pixels narrower than the grid, see writeIsometricBase
+	halfWidth := (tiles[0].Bounds().Dx() + 2) / 2
+	halfHeight := halfWidth / 2
+
+	positions := make([]image.Point, len(tiles))
+	var bounds image.Rectangle
+	for i, tile := range tiles {
+		col, row := i%cols, i/cols
+		footprintHeight := (tile.Bounds().Dx() + 2) / 2
+		positions[i] = image.Pt((col-row)*halfWidth, (col+row)*halfHeight-(tile.Bounds().Dy()-footprintHeight))
+		bounds = bounds.Union(tile.Bounds().Add(positions[i]))
+	}
+
+	result := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for i, tile := range tiles {
+		draw.Draw(result, tile.Bounds().Add(positions[i].Sub(bounds.Min)), tile, image.Point{}, draw.Over)
+	}
+	return result, nil
+}
+
+// Opens the appropriate .555 file to extract data, returns os.File object.
+// The file is shared with the other bitmaps of the sg file and may be closed
+// once more than the allowed number of data files are open. Fails if the
+// data source of the sg file doesn't provide files.
+func (sgBitmap *SgBitmap) OpenFile(isExtern bool) (*os.File, error) {
+	reader, _, err := sgBitmap.openData(isExtern)
+	if err != nil {
+		return nil, err
 	}
-	return sgBitmap.file, nil
+	file, ok := reader.(*os.File)
+	if !ok {
+		return nil, errors.New("Data source doesn't provide files")
+	}
+	return file, nil
 }
 
 // Close the .555 file after use
 func (sgBitmap *SgBitmap) CloseFile() error {
-	return sgBitmap.file.Close()
+	return sgBitmap.sgFile.dataFiles.close(sgBitmap.dataName)
 }
 
-func (sgBitmap *SgBitmap) find555File() (string, error) {
-	fi, err := os.Stat(sgBitmap.sgFilename)
-	if err != nil {
-		return "", err
-	}
+// Opens the appropriate .555 file through the data source of the sg file
+func (sgBitmap *SgBitmap) openData(isExtern bool) (io.ReaderAt, int64, error) {
+	sgBitmap.dataName = sgBitmap.find555File(isExtern)
+	return sgBitmap.sgFile.dataFiles.open(sgBitmap.dataName)
+}
 
+// Get the name of the .555 file holding the image data
+func (sgBitmap *SgBitmap) find555File(isExtern bool) string {
 	// Get the basename of the file
 	// either the same name as sg(2|3) or from file record
-	basename := ""
-	if sgBitmap.isExtern {
+	basename := sgBitmap.sgFile.baseFilename
+	if isExtern {
 		basename = sgBitmap.record.filenameString()
-	} else {
-		basename = fi.Name()
-	}
-
-	// Change the extension to .555
-	tmp := strings.SplitAfter(basename, ".")
-	if len(tmp) > 1 {
-		tmp[len(tmp)-1] = "555"
-		basename = strings.Join(tmp, "")
-	} else {
-		basename += ".555"
 	}
+	return dataFilename(basename)
+}
 
-	path, err := sgBitmap.findFilenameCaseInsensitive(filepath.Dir(sgBitmap.sgFilename), basename)
+// Look for the data file in directory, or in its 555 subdirectory. The
+// filename may be a relative path separated by slashes, each segment of
+// which is matched case-insensitively. Failures wrap ErrDataNotFound.
+func findDataFile(directory, filename string) (string, error) {
+	path, err := findPathCaseInsensitive(directory, filename)
 	if err == nil {
 		return path, nil
 	}
 
-	file, err := os.Open(filepath.Dir(sgBitmap.sgFilename) + string(os.PathSeparator) + "555")
-	defer file.Close()
+	// The subdirectory name may be cased differently as well
+	subdirectory, subErr := findFilenameCaseInsensitive(directory, "555")
+	if subErr != nil {
+		// Most directories have no 555 subdirectory, the first error tells
+		// more about what went wrong
+		return "", fmt.Errorf("%w: %w", ErrDataNotFound, err)
+	}
+	path, err = findPathCaseInsensitive(subdirectory, filename)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: %w", ErrDataNotFound, err)
+	}
+	return path, nil
+}
+
+// Find the file named by the slash separated path filename within
+// directory. The names come from the records of the sg file, so paths that
+// are absolute or have ".." segments are rejected rather than followed
+// outside directory.
+func findPathCaseInsensitive(directory, filename string) (string, error) {
+	if path.IsAbs(filename) {
+		return "", fmt.Errorf("Data file path %s is absolute", filename)
 	}
-	path, err = sgBitmap.findFilenameCaseInsensitive(filepath.Dir(sgBitmap.sgFilename)+string(os.PathSeparator)+"555", basename)
-	return path, err
+	current := directory
+	for _, segment := range strings.Split(filename, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("Data file path %s leads outside the data directory", filename)
+		}
+		var err error
+		current, err = findFilenameCaseInsensitive(current, segment)
+		if err != nil {
+			return "", err
+		}
+	}
+	return current, nil
+}
+
+// Change the extension of filename to .555. External bitmap records may
+// name the file by a relative Windows path, so the path is also cleaned and
+// its separators turned into slashes.
+func dataFilename(filename string) string {
+	filename = path.Clean(strings.ReplaceAll(filename, `\`, "/"))
+	return strings.TrimSuffix(filename, path.Ext(filename)) + ".555"
 }
 
-func (sgBitmap *SgBitmap) findFilenameCaseInsensitive(directory, filename string) (string, error) {
+func findFilenameCaseInsensitive(directory, filename string) (string, error) {
 	filename = strings.ToLower(filename)
 
 	dir, err := os.Open(directory)
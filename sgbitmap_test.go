@@ -0,0 +1,330 @@
+package sgreader
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Loads a file whose only image is external to a bitmap naming its data
+// file by name, with the sg file in root/data and files holding the data
+// written relative to it
+func loadExternalFixture(t *testing.T, name string, files ...string) *SgFile {
+	t.Helper()
+	root := t.TempDir()
+	dataDir := filepath.Join(root, "data")
+	image := SgImageRecord{Offset: 1, Length: 2, Width: 1, Height: 1}
+	image.Flags[0] = 1
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord(name, 1, 1)}, []SgImageRecord{image})
+	for _, file := range append(files, "test.sg3") {
+		filename := filepath.Join(dataDir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		data := plainData(0x7fff)
+		if file == "test.sg3" {
+			data = sg
+		}
+		if err := os.WriteFile(filename, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sgFile := ReadFile(filepath.Join(dataDir, "test.sg3"))
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return sgFile
+}
+
+func TestExternalFileInSubdirectory(t *testing.T) {
+	sgFile := loadExternalFixture(t, `SUB\Ext.bmp`, "sub/ext.555")
+	mustDecode(t, sgFile.GetBitmap(0).Image(0))
+}
+
+func TestExternalFileOutsideDataDirectory(t *testing.T) {
+	names := []string{`..\secret.bmp`, `sub\..\..\secret.bmp`, `\data\secret.bmp`}
+	for _, name := range names {
+		sgFile := loadExternalFixture(t, name, "../secret.555", "secret.555")
+		if _, err := sgFile.GetBitmap(0).GetImage(0); err == nil {
+			t.Errorf("Read the data file of %s", name)
+		}
+	}
+}
+
+func TestVerifyReportsImagesOutsideGlobalRange(t *testing.T) {
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Length: 2, Width: 1, Height: 1}}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 5, 6)}, images, plainData(0x7fff))
+
+	if start, end := sgFile.GetBitmap(0).GlobalRange(); start != 5 || end != 6 {
+		t.Errorf("Got range %d-%d, want 5-6", start, end)
+	}
+	want := "a: image ids 1-2 are outside the record range 5-6"
+	warnings := sgFile.Verify()
+	if len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("Got warnings %q, want %q", warnings, want)
+	}
+}
+
+func TestVerifyReportsImagesLargerThanBitmap(t *testing.T) {
+	bitmap := bitmapRecord("a.bmp", 1, 2)
+	bitmap.Width, bitmap.Height = 2, 2
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Width: 3, Height: 1}}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmap}, images, plainData(0x7fff))
+
+	want := "a: image 1 (3x1) is larger than the bitmap (2x2)"
+	warnings := sgFile.Verify()
+	if len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("Got warnings %q, want %q", warnings, want)
+	}
+}
+
+func TestVerifyReportsWrongImageCount(t *testing.T) {
+	bitmap := bitmapRecord("a.bmp", 1, 2)
+	bitmap.NumImages = 3
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Length: 2, Width: 1, Height: 1}}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmap}, images, plainData(0x7fff))
+
+	want := "a: record declares 3 images but 2 are attached"
+	warnings := sgFile.Verify()
+	if len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("Got warnings %q, want %q", warnings, want)
+	}
+}
+
+func TestLocalIndex(t *testing.T) {
+	// The images of the two bitmaps are interleaved in the image table
+	var images []SgImageRecord
+	for _, bitmapId := range []uint8{0, 1, 0, 1, 1} {
+		images = append(images, SgImageRecord{Length: 2, Width: 1, Height: 1, BitmapId: bitmapId})
+	}
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 3), bitmapRecord("b.bmp", 2, 5)}
+	sgFile := loadFixture(t, bitmaps, images, plainData(0x7fff))
+
+	for bitmapId, count := range []int{2, 3} {
+		bitmap := sgFile.GetBitmap(bitmapId)
+		if bitmap.ImageCount() != count {
+			t.Fatalf("Bitmap %s has %d images, want %d", bitmap.BitmapName(), bitmap.ImageCount(), count)
+		}
+		for i, sgImage := range bitmap.Images() {
+			if sgImage.LocalIndex() != i {
+				t.Errorf("Image %d of %s has local index %d", i, bitmap.BitmapName(), sgImage.LocalIndex())
+			}
+		}
+	}
+}
+
+func TestMirrorPairs(t *testing.T) {
+	// Two walker frames followed by their mirrored versions
+	images := []SgImageRecord{
+		{Length: 2, Width: 1, Height: 1},
+		{Offset: 2, Length: 2, Width: 1, Height: 1},
+		{InvertOffset: -2},
+		{InvertOffset: -2},
+	}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("walker.bmp", 1, 4)}, images, plainData(0x7c00, 0x001f))
+	pairs := sgFile.GetBitmap(0).MirrorPairs()
+	if want := [][2]int{{0, 2}, {1, 3}}; !slices.Equal(pairs, want) {
+		t.Errorf("Got pairs %v, want %v", pairs, want)
+	}
+}
+
+func TestDataFileIn555Subdirectory(t *testing.T) {
+	dir := t.TempDir()
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, []SgImageRecord{{Length: 2, Width: 1, Height: 1}})
+	if err := os.WriteFile(filepath.Join(dir, "test.sg3"), sg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "555"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "555", "TEST.555"), plainData(0x7fff), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sgFile := ReadFile(filepath.Join(dir, "test.sg3"))
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	mustDecode(t, sgFile.GetBitmap(0).Image(0))
+}
+
+func TestTotalStorageSize(t *testing.T) {
+	// The plain image takes 8 bytes and the sprite 12
+	if size := sampleFixture(t).GetBitmap(0).TotalStorageSize(); size != 20 {
+		t.Errorf("Got %d bytes, want 20", size)
+	}
+	// The alpha mask is counted along with the image data
+	if size := alphaFixture(t).GetBitmap(0).Image(0).StorageSize(); size != 20 {
+		t.Errorf("Got %d bytes, want 20", size)
+	}
+}
+
+func TestFileName(t *testing.T) {
+	bitmap := sampleFixture(t).GetBitmap(0)
+	if name := bitmap.FileName(); name != "Sample.bmp" {
+		t.Errorf("Got file name %q, want %q", name, "Sample.bmp")
+	}
+	if name := bitmap.BitmapName(); name != "sample" {
+		t.Errorf("Got bitmap name %q, want %q", name, "sample")
+	}
+}
+
+func TestOutputDir(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("Houses.bmp", 1, 1), bitmapRecord("Walls.bmp", 2, 2), bitmapRecord("", 3, 3)}
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Length: 2, Width: 1, Height: 1, BitmapId: 1}, {Length: 2, Width: 1, Height: 1, BitmapId: 2}}
+	sgFile := loadFixture(t, bitmaps, images, plainData(0x7fff))
+
+	root := t.TempDir()
+	for i, want := range []string{"houses", "walls", "bitmap_2"} {
+		dir, err := sgFile.GetBitmap(i).OutputDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dir != filepath.Join(root, want) {
+			t.Errorf("Got directory %s for bitmap %d, want %s", dir, i, filepath.Join(root, want))
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			t.Errorf("Directory %s wasn't created", dir)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := map[string]string{
+		"houses":        "houses",
+		`c:\game data`:  "c__game_data",
+		"a/b<c>d|e?f*g": "a_b_c_d_e_f_g",
+		"name\x01.":     "name_",
+		"...":           "_",
+		"":              "_",
+		`"quoted"`:      "_quoted_",
+	}
+	for name, want := range tests {
+		if got := SanitizeName(name); got != want {
+			t.Errorf("Got %q for %q, want %q", got, name, want)
+		}
+	}
+}
+
+func TestOutputDirSanitizesName(t *testing.T) {
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord(`..\Evil:Name.bmp`, 1, 1)}, []SgImageRecord{{Length: 2, Width: 1, Height: 1}}, plainData(0x7fff))
+	root := t.TempDir()
+	dir, err := sgFile.GetBitmap(0).OutputDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, ".._evil_name"); dir != want {
+		t.Errorf("Got directory %s, want %s", dir, want)
+	}
+}
+
+// Builds the data of an isometric image of a single tile in color c
+func isometricTile(c uint16) []byte {
+	pixels := make([]uint16, ISOMETRIC_TILE_BYTES/2)
+	for i := range pixels {
+		pixels[i] = c
+	}
+	return plainData(pixels...)
+}
+
+func TestIsometricComposite(t *testing.T) {
+	colors := []uint16{0x7c00, 0x03e0, 0x001f, 0x7fff}
+	var images []SgImageRecord
+	var data []byte
+	for _, c := range colors {
+		record := SgImageRecord{
+			Offset:             uint32(len(data)),
+			Length:             ISOMETRIC_TILE_BYTES,
+			UncompressedLength: ISOMETRIC_TILE_BYTES,
+			Width:              ISOMETRIC_TILE_WIDTH,
+			Height:             ISOMETRIC_TILE_HEIGHT,
+			Type:               uint16(TypeIsometric),
+		}
+		record.Flags[3] = 1
+		images = append(images, record)
+		data = append(data, isometricTile(c)...)
+	}
+	bitmap := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 4)}, images, data).GetBitmap(0)
+
+	composite, err := bitmap.IsometricComposite([]int{0, 1, 2, 3}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Columns go half a tile right and down, rows half a tile left and
+	// down, so the tile of the second row starts at the left edge
+	if want := image.Rect(0, 0, 118, 60); composite.Bounds() != want {
+		t.Fatalf("Got bounds %v, want %v", composite.Bounds(), want)
+	}
+	positions := []image.Point{{30, 0}, {60, 15}, {0, 15}, {30, 30}}
+	want := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}}
+	for i, position := range positions {
+		// The middle of the widest row of the tile
+		if got := composite.RGBAAt(position.X+29, position.Y+14); got != want[i] {
+			t.Errorf("Got %v in the middle of tile %d, want %v", got, i, want[i])
+		}
+	}
+	// The corners between the tiles are left transparent
+	if got := composite.RGBAAt(0, 0); got != (color.RGBA{}) {
+		t.Errorf("Got corner %v, want transparent", got)
+	}
+}
+
+func TestUsesExternalData(t *testing.T) {
+	internal := SgImageRecord{Length: 2, Width: 1, Height: 1}
+	external := internal
+	external.Flags[0] = 1
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 2), bitmapRecord("b.bmp", 3, 4), bitmapRecord("c.bmp", 5, 6)}
+	images := []SgImageRecord{internal, internal, external, external, internal, external}
+	for i := range images {
+		images[i].BitmapId = uint8(i / 2)
+	}
+	sgFile := loadFixture(t, bitmaps, images, plainData(0x7fff))
+
+	tests := []struct {
+		external, mixed bool
+	}{
+		{false, false},
+		{true, false},
+		{true, true},
+	}
+	for i, test := range tests {
+		bitmap := sgFile.GetBitmap(i)
+		if bitmap.UsesExternalData() != test.external || bitmap.MixedData() != test.mixed {
+			t.Errorf("Bitmap %d: got external %v mixed %v, want %v and %v", i, bitmap.UsesExternalData(), bitmap.MixedData(), test.external, test.mixed)
+		}
+	}
+}
+
+func TestDimensions(t *testing.T) {
+	record := bitmapRecord("a.bmp", 1, 1)
+	record.Width, record.Height = 640, 480
+	sgFile := loadFixture(t, []SgBitmapRecord{record}, []SgImageRecord{{Length: 2, Width: 1, Height: 1}}, plainData(0x7fff))
+	if width, height := sgFile.GetBitmap(0).Dimensions(); width != 640 || height != 480 {
+		t.Errorf("Got %dx%d, want 640x480", width, height)
+	}
+}
+
+func TestMissingDataFileOrDirectory(t *testing.T) {
+	tests := map[string]*SgFile{
+		"file":      loadExternalFixture(t, "Ext.bmp"),
+		"directory": loadExternalFixture(t, `SUB\Ext.bmp`),
+	}
+	for missing, sgFile := range tests {
+		if _, err := sgFile.GetBitmap(0).GetImage(0); !errors.Is(err, ErrDataNotFound) {
+			t.Errorf("Missing %s: got error %v, want ErrDataNotFound", missing, err)
+		}
+	}
+
+	sgFile := loadExternalFixture(t, "Ext.bmp", "ext.555")
+	if err := sgFile.SetDataRoot(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sgFile.GetBitmap(0).GetImage(0); !errors.Is(err, ErrDataNotFound) {
+		t.Errorf("Missing data root: got error %v, want ErrDataNotFound", err)
+	}
+}
@@ -0,0 +1,128 @@
+package sgreader
+
+import (
+	"container/list"
+	"io"
+)
+
+const (
+	defaultMaxOpenFiles int = 16
+)
+
+type dataFile struct {
+	name   string
+	reader io.ReaderAt
+	size   int64
+}
+
+// dataFiles keeps the .555 files used by the bitmaps of an sg file open,
+// closing the least recently used file when too many are open
+type dataFiles struct {
+	source DataSource
+	max    int
+	order  *list.List // most recently used at the front
+	files  map[string]*list.Element
+}
+
+func newDataFiles(source DataSource, max int) *dataFiles {
+	return &dataFiles{
+		source: source,
+		max:    max,
+		order:  list.New(),
+		files:  make(map[string]*list.Element),
+	}
+}
+
+func (files *dataFiles) open(name string) (io.ReaderAt, int64, error) {
+	if element, ok := files.files[name]; ok {
+		files.order.MoveToFront(element)
+		data := element.Value.(*dataFile)
+		return data.reader, data.size, nil
+	}
+
+	// Make room first so that no more than max files are open at any time.
+	// Failing to close a read-only file doesn't affect the one to open.
+	files.evict(1)
+	reader, size, err := files.source.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	files.files[name] = files.order.PushFront(&dataFile{name: name, reader: reader, size: size})
+	return reader, size, nil
+}
+
+func (files *dataFiles) close(name string) error {
+	element, ok := files.files[name]
+	if !ok {
+		return nil
+	}
+	return files.remove(element)
+}
+
+// Close the open files and read future files from source
+func (files *dataFiles) setSource(source DataSource) error {
+	err := files.closeAll()
+	files.source = source
+	return err
+}
+
+func (files *dataFiles) closeAll() error {
+	var err error
+	for files.order.Len() > 0 {
+		if closeErr := files.remove(files.order.Back()); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (files *dataFiles) setMax(max int) error {
+	files.max = max
+	return files.evict(0)
+}
+
+// Close the least recently used files until reserve more files can be
+// opened within the limit
+func (files *dataFiles) evict(reserve int) error {
+	var err error
+	for files.max > 0 && files.order.Len() > 0 && files.order.Len()+reserve > files.max {
+		if closeErr := files.remove(files.order.Back()); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (files *dataFiles) remove(element *list.Element) error {
+	data := files.order.Remove(element).(*dataFile)
+	delete(files.files, data.name)
+	if closer, ok := data.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// dataReaders opens data files for use by a single goroutine, independently
+// of the files shared by the bitmaps. The goroutines decoding a file
+// together split the open file limit of the sg file between them.
+type dataReaders struct {
+	files *dataFiles
+}
+
+// Returns the readers for one of concurrency goroutines reading the data
+// files of sgFile
+func (sgFile *SgFile) newDataReaders(concurrency int) *dataReaders {
+	limit := sgFile.dataFiles.max
+	if limit > 0 {
+		limit = max(1, limit/max(1, concurrency))
+	}
+	return &dataReaders{files: newDataFiles(sgFile.dataSource, limit)}
+}
+
+func (readers *dataReaders) open(name string) (io.ReaderAt, int64, error) {
+	return readers.files.open(name)
+}
+
+func (readers *dataReaders) close() {
+	readers.files.closeAll()
+}
@@ -0,0 +1,96 @@
+package sgreader
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+	"testing"
+)
+
+// countingSource serves the same data for every name and tracks how many of
+// its readers are open at once
+type countingSource struct {
+	data []byte
+	mu   sync.Mutex
+	open int
+	peak int
+}
+
+type countingReader struct {
+	*bytes.Reader
+	source *countingSource
+}
+
+func (ds *countingSource) Open(name string) (io.ReaderAt, int64, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.open++
+	ds.peak = max(ds.peak, ds.open)
+	return countingReader{bytes.NewReader(ds.data), ds}, int64(len(ds.data)), nil
+}
+
+func (r countingReader) Close() error {
+	r.source.mu.Lock()
+	defer r.source.mu.Unlock()
+	r.source.open--
+	return nil
+}
+
+// Loads a file with n bitmaps that each keep their single image in a data
+// file of their own, served by source
+func loadExternalBitmaps(t *testing.T, source DataSource, n int) *SgFile {
+	t.Helper()
+	var bitmaps []SgBitmapRecord
+	var images []SgImageRecord
+	for i := 0; i < n; i++ {
+		bitmaps = append(bitmaps, bitmapRecord(fmt.Sprintf("e%d.bmp", i), uint32(i+1), uint32(i+1)))
+		image := SgImageRecord{Offset: 1, Length: 2, Width: 1, Height: 1, BitmapId: uint8(i)}
+		image.Flags[0] = 1
+		images = append(images, image)
+	}
+	sg := buildSG(t, versionSG3, bitmaps, images)
+	sgFile, err := ReadReaderAt(bytes.NewReader(sg), int64(len(sg)), source, "test.sg3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sgFile
+}
+
+func TestBitmapsShareOpenFileLimit(t *testing.T) {
+	source := &countingSource{data: plainData(0x7fff)}
+	sgFile := loadExternalBitmaps(t, source, 8)
+	if err := sgFile.SetMaxOpenFiles(3); err != nil {
+		t.Fatal(err)
+	}
+	for _, bitmap := range sgFile.Bitmaps() {
+		mustDecode(t, bitmap.Image(0))
+	}
+	if source.peak > 3 {
+		t.Errorf("Up to %d data files were open at once, want at most 3", source.peak)
+	}
+}
+
+func TestDecodeWorkersShareOpenFileLimit(t *testing.T) {
+	source := &countingSource{data: plainData(0x7fff)}
+	sgFile := loadExternalBitmaps(t, source, 8)
+	if err := sgFile.SetMaxOpenFiles(4); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := 0
+	err := sgFile.DecodeOrdered(2, func(ImageRef, *image.RGBA) { decoded++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != 8 {
+		t.Errorf("Decoded %d images, want 8", decoded)
+	}
+	if source.peak > 4 {
+		t.Errorf("Up to %d data files were open at once, want at most 4", source.peak)
+	}
+	if source.open != 0 {
+		t.Errorf("%d data files left open", source.open)
+	}
+}
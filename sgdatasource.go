@@ -0,0 +1,196 @@
+package sgreader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DataSource provides the .555 files holding the image data of an sg file
+type DataSource interface {
+	// Open returns a reader for the named data file along with its size. The
+	// name is usually a bare file name, but may be a relative path separated
+	// by slashes when a bitmap record names its file that way. The reader is
+	// closed when no longer needed if it implements io.Closer.
+	Open(name string) (io.ReaderAt, int64, error)
+}
+
+// dirDataSource looks up data files case-insensitively in a directory and
+// its 555 subdirectory. Gzip compressed files are decompressed into memory.
+type dirDataSource struct {
+	dir string
+	// When set, the data file of this name is replaced by the only .555 file
+	// in dir if it doesn't exist
+	fallbackName string
+}
+
+func (ds *dirDataSource) Open(name string) (io.ReaderAt, int64, error) {
+	path, err := findDataFile(ds.dir, name)
+	if err != nil && ds.fallbackName != "" && strings.EqualFold(name, ds.fallbackName) {
+		path, err = findSingleDataFile(ds.dir)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	reader, size, err := gunzipReaderAt(file, fi.Size())
+	if reader != io.ReaderAt(file) {
+		file.Close()
+	}
+	return reader, size, err
+}
+
+// Get the path of the only .555 file in dir, failing with ErrDataNotFound if
+// there are none or more than one
+func findSingleDataFile(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrDataNotFound, err)
+	}
+	var found []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".555") {
+			found = append(found, entry.Name())
+		}
+	}
+	if len(found) != 1 {
+		return "", fmt.Errorf("%w: expected a single .555 file in directory %s, found %d", ErrDataNotFound, dir, len(found))
+	}
+	return filepath.Join(dir, found[0]), nil
+}
+
+// Returns the contents of r decompressed into memory if they start with the
+// gzip magic number, or r itself otherwise. Images are read at random
+// offsets, which a gzip stream can't provide.
+func gunzipReaderAt(r io.ReaderAt, size int64) (io.ReaderAt, int64, error) {
+	var magic [2]byte
+	if n, _ := r.ReadAt(magic[:], 0); n < len(magic) || magic != [2]byte{0x1f, 0x8b} {
+		return r, size, nil
+	}
+	zr, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// memDataSource holds the contents of the data files in memory, by name
+type memDataSource map[string][]byte
+
+func (ds memDataSource) Open(name string) (io.ReaderAt, int64, error) {
+	data, ok := ds[name]
+	if !ok {
+		for key, value := range ds {
+			if strings.EqualFold(key, name) {
+				data, ok = value, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s", ErrDataNotFound, name)
+	}
+	return gunzipReaderAt(bytes.NewReader(data), int64(len(data)))
+}
+
+// HTTPDataSource reads data files from BaseURL with HTTP range requests, so
+// only the bytes of the images being decoded are downloaded
+type HTTPDataSource struct {
+	BaseURL string
+	// Client is used for the requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+func (ds *HTTPDataSource) Open(name string) (io.ReaderAt, int64, error) {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return OpenHTTP(ds.Client, strings.TrimSuffix(ds.BaseURL, "/")+"/"+strings.Join(segments, "/"))
+}
+
+// Returns an io.ReaderAt for the resource at url that fetches the requested
+// bytes with HTTP range requests, along with the size of the resource. The
+// server must report the size in response to a HEAD request.
+func OpenHTTP(client *http.Client, url string) (io.ReaderAt, int64, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Head(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("Unable to open %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return nil, 0, fmt.Errorf("Unable to open %s: size unknown", url)
+	}
+	return &httpReaderAt{client: client, url: url, size: resp.ContentLength}, resp.ContentLength, nil
+}
+
+type httpReaderAt struct {
+	client *http.Client
+	url    string
+	size   int64
+}
+
+func (r *httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sent the whole resource
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("Unable to read %s: %s", r.url, resp.Status)
+	}
+
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
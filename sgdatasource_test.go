@@ -0,0 +1,98 @@
+package sgreader
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeReaderAt serves data and records the ranges read from it
+type rangeReaderAt struct {
+	data   []byte
+	mu     sync.Mutex
+	ranges [][2]int64
+}
+
+func (r *rangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	r.ranges = append(r.ranges, [2]int64{off, off + int64(len(p))})
+	r.mu.Unlock()
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestReadReaderAt(t *testing.T) {
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Offset: 2, Length: 2, Width: 1, Height: 1}}
+	sg := &rangeReaderAt{data: buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 2)}, images)}
+	data := &rangeReaderAt{data: plainData(0x7c00, 0x001f)}
+	sgFile, err := ReadReaderAt(sg, int64(len(sg.data)), readerAtSource{"test.555": data}, "test.sg3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0, 0, 255, 255}
+	if pix := mustDecode(t, sgFile.GetBitmap(0).Image(1)); !bytes.Equal(pix, want) {
+		t.Errorf("Got pixels %v, want %v", pix, want)
+	}
+	// Only the bytes of the decoded image are read from the data file,
+	// besides the gzip check at its start
+	for _, r := range data.ranges {
+		if r != [2]int64{0, 2} && r != [2]int64{2, 4} {
+			t.Errorf("Read bytes %d to %d of the data file", r[0], r[1])
+		}
+	}
+}
+
+// readerAtSource serves the data files from readers, by name
+type readerAtSource map[string]*rangeReaderAt
+
+func (ds readerAtSource) Open(name string) (io.ReaderAt, int64, error) {
+	r, ok := ds[name]
+	if !ok {
+		return nil, 0, ErrDataNotFound
+	}
+	return r, int64(len(r.data)), nil
+}
+
+func TestHTTPDataSource(t *testing.T) {
+	data := plainData(0x7c00, 0x03e0, 0x001f, 0x7fff)
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/files/test.555" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		if r.Method == http.MethodGet {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+		mu.Unlock()
+		http.ServeContent(w, r, "test.555", time.Time{}, strings.NewReader(string(data)))
+	}))
+	defer server.Close()
+
+	images := []SgImageRecord{{Length: 4, Width: 2, Height: 1}, {Offset: 4, Length: 4, Width: 2, Height: 1}}
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 2)}, images)
+	sgFile, err := ReadReaderAt(bytes.NewReader(sg), int64(len(sg)), &HTTPDataSource{BaseURL: server.URL + "/files/"}, "test.sg3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0, 0, 255, 255, 255, 255, 255, 255}
+	if pix := mustDecode(t, sgFile.GetBitmap(0).Image(1)); !bytes.Equal(pix, want) {
+		t.Errorf("Got pixels %v, want %v", pix, want)
+	}
+	for _, r := range ranges {
+		if r != "bytes=0-1" && r != "bytes=4-7" {
+			t.Errorf("Requested %q, want only the gzip check and the image", r)
+		}
+	}
+	if len(ranges) == 0 {
+		t.Error("No range requests made")
+	}
+}
@@ -0,0 +1,144 @@
+package sgreader
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"runtime"
+	"sync"
+)
+
+type decodeResult struct {
+	img *image.RGBA
+	err error
+}
+
+// Decodes the images of the file using concurrency goroutines and calls fn
+// for each of them strictly in file order. Decoding runs at most a few images
+// ahead of fn so memory use stays bounded. Placeholder images without data
+// and images without a bitmap are skipped. Stops at the first image that
+// fails to decode and returns its error.
+func (sgFile *SgFile) DecodeOrdered(concurrency int, fn func(ImageRef, *image.RGBA)) error {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	var images []*SgImage
+	for _, sgImage := range sgFile.images {
+		if sgImage.parent != nil && sgImage.checkRecord() == nil {
+			images = append(images, sgImage)
+		}
+	}
+
+	// Each image gets its own result slot, consumed in order
+	results := make([]chan decodeResult, len(images))
+	for i := range results {
+		results[i] = make(chan decodeResult, 1)
+	}
+	window := make(chan struct{}, 2*concurrency)
+	jobs := make(chan int)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	// The producer must be released before waiting for the workers, which
+	// wait for the jobs it no longer sends once fn stops consuming
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	go func() {
+		defer close(jobs)
+		for i := range images {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readers := sgFile.newDataReaders(concurrency)
+			defer readers.close()
+			for i := range jobs {
+				img, err := images[i].decodeWith(readers, DecodeOptions{})
+				results[i] <- decodeResult{img: img, err: err}
+			}
+		}()
+	}
+
+	for i, sgImage := range images {
+		result := <-results[i]
+		<-window
+		if result.err != nil {
+			return fmt.Errorf("Image %d: %w", sgImage.imageId, result.err)
+		}
+		fn(sgImage.Ref(), result.img)
+	}
+	return nil
+}
+
+// Decodes the images of the bitmap into the image cache of the file using
+// concurrency goroutines, so that later GetImage calls find them there. Does
+// nothing when the cache is disabled, and a cache smaller than the bitmap
+// only keeps the images decoded last. Stops early with the error of ctx when
+// it is cancelled, otherwise returns the decoding failures as a *MultiError.
+func (sgBitmap *SgBitmap) Warmup(ctx context.Context, concurrency int) error {
+	cache := sgBitmap.sgFile.imageCache
+	if cache == nil {
+		return nil
+	}
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	jobs := make(chan *SgImage)
+	errs := make([]error, len(sgBitmap.images))
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readers := sgBitmap.sgFile.newDataReaders(concurrency)
+			defer readers.close()
+			for sgImage := range jobs {
+				if _, ok := cache.get(sgImage.imageId); ok {
+					continue
+				}
+				img, err := sgImage.decodeWith(readers, DecodeOptions{})
+				if err != nil {
+					errs[sgImage.localIndex] = fmt.Errorf("Image %d: %w", sgImage.imageId, err)
+					continue
+				}
+				cache.put(sgImage.imageId, img)
+			}
+		}()
+	}
+
+queue:
+	for _, sgImage := range sgBitmap.images {
+		if sgImage.checkRecord() != nil {
+			continue
+		}
+		select {
+		case jobs <- sgImage:
+		case <-ctx.Done():
+			break queue
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return newMultiError(errs)
+}
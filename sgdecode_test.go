@@ -0,0 +1,100 @@
+package sgreader
+
+import (
+	"context"
+	"errors"
+	"image"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDecodeOrderedStopsAtFirstError(t *testing.T) {
+	// The first image is too short for its size, the others decode
+	images := []SgImageRecord{{Length: 1, Width: 1, Height: 1}}
+	for i := 0; i < 39; i++ {
+		images = append(images, SgImageRecord{Length: 2, Width: 1, Height: 1})
+	}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("test.bmp", 1, 40)}, images, plainData(0x7fff))
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sgFile.DecodeOrdered(1, func(ImageRef, *image.RGBA) {
+			t.Error("Called fn after the first image failed")
+		})
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Expected the error of the first image")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DecodeOrdered didn't return after the first image failed")
+	}
+}
+
+func TestDecodeOrderedKeepsFileOrder(t *testing.T) {
+	// Every fourth image is much larger than the others, so the small images
+	// queued behind it finish decoding first
+	var sizes []int
+	for i := 0; i < 36; i++ {
+		if i%4 == 0 {
+			sizes = append(sizes, 200)
+		} else {
+			sizes = append(sizes, 1+i%5)
+		}
+	}
+	sgFile := manyFixture(t, sizes)
+
+	var want []ImageRef
+	for _, sgImage := range sgFile.Images() {
+		want = append(want, sgImage.Ref())
+	}
+	var got []ImageRef
+	err := sgFile.DecodeOrdered(4, func(ref ImageRef, img *image.RGBA) {
+		if size := sizes[len(got)]; img.Bounds().Dx() != size {
+			t.Errorf("Image %d: got width %d, want %d", len(got), img.Bounds().Dx(), size)
+		}
+		got = append(got, ref)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Got images %v, want %v", got, want)
+	}
+}
+
+func TestWarmupFillsCache(t *testing.T) {
+	var images []SgImageRecord
+	for i := 0; i < 4; i++ {
+		images = append(images, SgImageRecord{Length: 2, Width: 1, Height: 1})
+	}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 4)}, images, plainData(0x7fff))
+	sgFile.EnableCache(10)
+
+	bitmap := sgFile.GetBitmap(0)
+	if err := bitmap.Warmup(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, sgImage := range bitmap.Images() {
+		if _, ok := sgFile.imageCache.get(sgImage.ImageId()); !ok {
+			t.Errorf("Image %d isn't cached", sgImage.ImageId())
+		}
+	}
+}
+
+func TestWarmupStopsWhenCancelled(t *testing.T) {
+	var images []SgImageRecord
+	for i := 0; i < 40; i++ {
+		images = append(images, SgImageRecord{Length: 2, Width: 1, Height: 1})
+	}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 40)}, images, plainData(0x7fff))
+	sgFile.EnableCache(40)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sgFile.GetBitmap(0).Warmup(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Got error %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,92 @@
+package sgreader
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Compares two sg files and returns the references of the images that
+// differ, matching images by bitmap name and index. Images that only exist
+// in one of the files are included. Images whose records have a different
+// size are reported without decoding, the others are decoded and compared
+// pixel by pixel. When a name is used by several bitmaps only the first is
+// compared. Images that fail to decode in either file are counted as
+// differing, and their errors are returned together as a *MultiError along
+// with the complete list.
+func Diff(a, b *SgFile) ([]ImageRef, error) {
+	var changed []ImageRef
+	var errs []error
+	bitmapsA := bitmapsByName(a)
+	bitmapsB := bitmapsByName(b)
+
+	for _, bitmapA := range a.bitmaps {
+		name := bitmapA.BitmapName()
+		if bitmapsA[name] != bitmapA {
+			continue
+		}
+		bitmapB := bitmapsB[name]
+		for i, imageA := range bitmapA.images {
+			if bitmapB == nil || i >= len(bitmapB.images) {
+				changed = append(changed, imageA.Ref())
+				continue
+			}
+			equal, err := imagesEqual(imageA, bitmapB.images[i])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Unable to compare %s image %d: %w", name, i, err))
+			}
+			if !equal {
+				changed = append(changed, imageA.Ref())
+			}
+		}
+		// Images added to the bitmap in b
+		if bitmapB != nil {
+			for _, imageB := range bitmapB.images[min(len(bitmapA.images), len(bitmapB.images)):] {
+				changed = append(changed, imageB.Ref())
+			}
+		}
+	}
+
+	// Bitmaps only present in b
+	for _, bitmapB := range b.bitmaps {
+		name := bitmapB.BitmapName()
+		if bitmapsB[name] != bitmapB || bitmapsA[name] != nil {
+			continue
+		}
+		for _, imageB := range bitmapB.images {
+			changed = append(changed, imageB.Ref())
+		}
+	}
+	return changed, newMultiError(errs)
+}
+
+// Map the bitmap names to the first bitmap using them
+func bitmapsByName(sgFile *SgFile) map[string]*SgBitmap {
+	bitmaps := make(map[string]*SgBitmap)
+	for _, bitmap := range sgFile.bitmaps {
+		if _, ok := bitmaps[bitmap.BitmapName()]; !ok {
+			bitmaps[bitmap.BitmapName()] = bitmap
+		}
+	}
+	return bitmaps
+}
+
+func imagesEqual(a, b *SgImage) (bool, error) {
+	recordA, recordB := a.workRecord, b.workRecord
+	if recordA.Width != recordB.Width || recordA.Height != recordB.Height || recordA.Length != recordB.Length {
+		return false, nil
+	}
+	// Images without data can only be compared by their records
+	if a.checkRecord() != nil || b.checkRecord() != nil {
+		return true, nil
+	}
+
+	imgA, err := a.GetImage()
+	if err != nil {
+		return false, err
+	}
+	imgB, err := b.GetImage()
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(imgA.Pix, imgB.Pix), nil
+}
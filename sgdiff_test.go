@@ -0,0 +1,35 @@
+package sgreader
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestDiffContinuesAfterDecodeFailure(t *testing.T) {
+	images := []SgImageRecord{
+		{Offset: 0, Length: 2, Width: 1, Height: 1},
+		{Offset: 2, Length: 2, Width: 1, Height: 1},
+		{Offset: 4, Length: 2, Width: 1, Height: 1},
+	}
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 3)}
+	a := loadFixture(t, bitmaps, images, plainData(0x7c00, 0x03e0, 0x001f))
+	// In b the first image has a type that can't be decoded and the last
+	// image has a different color
+	changedImages := slices.Clone(images)
+	changedImages[0].Type = 99
+	b := loadFixture(t, bitmaps, changedImages, plainData(0x7c00, 0x03e0, 0x7fff))
+
+	changed, err := Diff(a, b)
+	var multi *MultiError
+	if !errors.As(err, &multi) || len(multi.Errors) != 1 {
+		t.Errorf("Got error %v, want the failure of the first image", err)
+	}
+	var indices []int
+	for _, ref := range changed {
+		indices = append(indices, ref.Index)
+	}
+	if !slices.Equal(indices, []int{0, 2}) {
+		t.Errorf("Got changed images %v, want 0 and 2", indices)
+	}
+}
@@ -1,18 +1,30 @@
 package sgreader
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
 	"io"
+	"iter"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 const (
 	headerSize int = 680
 )
 
+// ReservedImageCount is the number of dummy records at the start of the
+// image table. They aren't counted in NumImageRecords and aren't loaded, so
+// the image at global index i has id i+ReservedImageCount in the game.
+const ReservedImageCount = 1
+
 type SgHeader struct {
 	SgFilesize                    uint32
 	Version                       uint32
@@ -28,6 +40,12 @@ type SgHeader struct {
 
 func newHeader(r io.ReadSeeker) (*SgHeader, error) {
 	header := &SgHeader{}
+	// The struct only covers the start of the header, the rest is skipped by
+	// seeking to headerSize. Reading more than that would misalign the
+	// bitmap records.
+	if size := binary.Size(header); size > headerSize {
+		return nil, fmt.Errorf("Header struct size %d exceeds header size %d", size, headerSize)
+	}
 	err := binary.Read(r, binary.LittleEndian, header)
 	if err != nil {
 		return nil, err
@@ -38,56 +56,275 @@ func newHeader(r io.ReadSeeker) (*SgHeader, error) {
 
 // SgFile holds data for the bitmaps and images stored in the data file
 type SgFile struct {
+	// OnBitmapLoaded is called by Load after reading each bitmap record, so
+	// progress can be shown while the file is parsed. Images are attached to
+	// the bitmaps afterwards.
+	OnBitmapLoaded func(index int, b *SgBitmap)
+
 	bitmaps      []*SgBitmap
 	images       []*SgImage
 	filename     string
 	baseFilename string
 	header       *SgHeader
+	reader       io.ReaderAt
+	size         int64
+	dataSource   DataSource
+	dataFiles    *dataFiles
+	imageCache   *imageCache
+	strict       bool
+	lazy         bool
+	lastStats    ExtractStats
+	skipped      []SkipRecord
+	// Number of junk bytes before the header of the file
+	offset       int64
+	dataFallback bool
+	// Decompressed contents of a gzip compressed file, kept by lazy files
+	// so each bitmap doesn't decompress the whole file again
+	unpacked     io.ReaderAt
+	unpackedSize int64
 }
 
 // Returns a new SgFile object that is tied to the file
 func ReadFile(filename string) *SgFile {
 	baseFilename := filepath.Base(filename)
+	dataSource := &dirDataSource{dir: filepath.Dir(filename)}
 	return &SgFile{
 		filename:     filename,
 		baseFilename: baseFilename,
+		dataSource:   dataSource,
+		dataFiles:    newDataFiles(dataSource, defaultMaxOpenFiles),
+	}
+}
+
+// Returns a new SgFile object that is tied to the file, whose sg data starts
+// offset bytes into the file. Some redistributed files have a few junk bytes
+// in front of the header.
+func ReadFileAt(filename string, offset int64) *SgFile {
+	sgFile := ReadFile(filename)
+	sgFile.offset = offset
+	return sgFile
+}
+
+// Returns a new SgFile object that is tied to the file and only reads the
+// image records of a bitmap when the bitmap is first accessed through
+// GetBitmap, BitmapByName, Bitmaps or LoadBitmap. Only the records in the
+// GlobalRange of the bitmap are read. Methods that work on all images of
+// the file, such as Images and TotalImageCount, don't see the images of
+// lazily loaded bitmaps.
+func ReadFileLazy(filename string) *SgFile {
+	sgFile := ReadFile(filename)
+	sgFile.lazy = true
+	return sgFile
+}
+
+// Reads only the header and bitmap records of the sg file, without reading
+// the image records or opening the .555 files, to catalog files quickly
+func ReadMetadata(filename string) (*SgHeader, []SgBitmapRecord, error) {
+	sgFile := ReadFile(filename)
+	var records []SgBitmapRecord
+	err := sgFile.withFile(func(file io.ReadSeeker, size int64) error {
+		var err error
+		sgFile.header, err = newHeader(file)
+		if err != nil {
+			return err
+		}
+		if !sgFile.checkVersion(size) {
+			return errors.New("Incorrect sg version")
+		}
+		// The records are allocated up front, so the count from the header
+		// is checked against the room the file has for them
+		if count := sgFile.header.NumBitmapRecords; count < 0 || int64(count) > (size-int64(headerSize))/int64(recordSize) {
+			return fmt.Errorf("Invalid number of bitmap records: %d", count)
+		}
+
+		records = make([]SgBitmapRecord, sgFile.header.NumBitmapRecords)
+		return binary.Read(file, binary.LittleEndian, records)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return sgFile.header, records, nil
+}
+
+// Loads an sg file of sgSize bytes read from sg, with the .555 files
+// provided by ds. The name of the sg file is used to derive the name of its
+// own .555 file.
+func ReadReaderAt(sg io.ReaderAt, sgSize int64, ds DataSource, name string) (*SgFile, error) {
+	sgFile := &SgFile{
+		filename:     name,
+		baseFilename: filepath.Base(name),
+		reader:       sg,
+		size:         sgSize,
+		dataSource:   ds,
+		dataFiles:    newDataFiles(ds, defaultMaxOpenFiles),
+	}
+	if err := sgFile.Load(); err != nil {
+		return nil, err
+	}
+	return sgFile, nil
+}
+
+// Loads an sg file from memory, with the contents of its .555 files given
+// by name in data. Names are matched case-insensitively, as on disk.
+func ReadMemory(sg []byte, data map[string][]byte, name string) (*SgFile, error) {
+	return ReadReaderAt(bytes.NewReader(sg), int64(len(sg)), memDataSource(data), name)
+}
+
+// Set the maximum number of .555 files kept open at once by the bitmaps of
+// this file. The least recently used file is closed when the limit is
+// exceeded, a limit of 0 or less keeps every file open.
+func (sgFile *SgFile) SetMaxOpenFiles(n int) error {
+	return sgFile.dataFiles.setMax(n)
+}
+
+// Look for the .555 files in dir and its 555 subdirectory instead of the
+// directory of the sg file. An empty dir restores the directory of the sg
+// file.
+func (sgFile *SgFile) SetDataRoot(dir string) error {
+	if dir == "" {
+		dir = filepath.Dir(sgFile.filename)
+	}
+	sgFile.dataSource = sgFile.newDirDataSource(dir)
+	return sgFile.dataFiles.setSource(sgFile.dataSource)
+}
+
+// Use the only .555 file in the data directory when the .555 file named
+// after the sg file doesn't exist. This is off by default, as the lone file
+// may well belong to another sg file. It has no effect on data sources
+// other than directories.
+func (sgFile *SgFile) SetDataFileFallback(enabled bool) error {
+	sgFile.dataFallback = enabled
+	ds, ok := sgFile.dataSource.(*dirDataSource)
+	if !ok {
+		return nil
+	}
+	sgFile.dataSource = sgFile.newDirDataSource(ds.dir)
+	return sgFile.dataFiles.setSource(sgFile.dataSource)
+}
+
+func (sgFile *SgFile) newDirDataSource(dir string) *dirDataSource {
+	ds := &dirDataSource{dir: dir}
+	if sgFile.dataFallback {
+		ds.fallbackName = dataFilename(sgFile.baseFilename)
 	}
+	return ds
 }
 
-// Attempts to load the bitmaps and images stored within the sg data file
+// Keep up to maxImages decoded images in memory so that GetImage doesn't
+// decode the same image again. Cached images are shared between callers and
+// must not be modified. A maxImages of 0 or less disables the cache.
+func (sgFile *SgFile) EnableCache(maxImages int) {
+	if maxImages <= 0 {
+		sgFile.imageCache = nil
+		return
+	}
+	sgFile.imageCache = newImageCache(maxImages)
+}
+
+// In strict mode Load fails when the file contains images of a type that
+// can't be decoded, instead of leaving the error to GetImage
+func (sgFile *SgFile) SetStrict(strict bool) {
+	sgFile.strict = strict
+}
+
+// Attempts to load the bitmaps and images stored within the sg data file.
+// Calling it again reloads the file and clears the image cache.
 func (sgFile *SgFile) Load() error {
+	sgFile.unpacked, sgFile.unpackedSize = nil, 0
+	return sgFile.withFile(sgFile.load)
+}
+
+// Open the sg file and pass it to fn along with its size. Gzip compressed
+// files are decompressed into memory first.
+func (sgFile *SgFile) withFile(fn func(file io.ReadSeeker, size int64) error) error {
+	if sgFile.unpacked != nil {
+		return fn(io.NewSectionReader(sgFile.unpacked, 0, sgFile.unpackedSize), sgFile.unpackedSize)
+	}
+	if sgFile.reader != nil {
+		return sgFile.withReaderAt(sgFile.reader, sgFile.size, fn)
+	}
+
 	file, err := os.OpenFile(sgFile.filename, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size() - sgFile.offset
+	if sgFile.offset < 0 || size < 0 {
+		return fmt.Errorf("Invalid offset %d for a file of %d bytes", sgFile.offset, fi.Size())
+	}
+	return sgFile.withReaderAt(io.NewSectionReader(file, sgFile.offset, size), size, fn)
+}
+
+func (sgFile *SgFile) withReaderAt(r io.ReaderAt, size int64, fn func(file io.ReadSeeker, size int64) error) error {
+	unpacked, unpackedSize, err := gunzipReaderAt(r, size)
 	if err != nil {
 		return err
 	}
+	// Files read from disk are only held in memory once decompressed
+	if _, inMemory := unpacked.(*bytes.Reader); inMemory && sgFile.lazy {
+		sgFile.unpacked, sgFile.unpackedSize = unpacked, unpackedSize
+	}
+	return fn(io.NewSectionReader(unpacked, 0, unpackedSize), unpackedSize)
+}
+
+func (sgFile *SgFile) load(file io.ReadSeeker, size int64) error {
+	if sgFile.imageCache != nil {
+		sgFile.imageCache = newImageCache(sgFile.imageCache.max)
+	}
 
+	var err error
 	sgFile.header, err = newHeader(file)
 	if err != nil {
 		return err
 	}
 
-	if !sgFile.checkVersion() {
+	if !sgFile.checkVersion(size) {
 		return errors.New("Incorrect sg version")
 	}
 
 	fmt.Printf("Read header, num bitmaps = %d, num images = %d\n", sgFile.header.NumBitmapRecords, sgFile.header.NumImageRecords)
 
+	if sgFile.header.NumBitmapRecords < 0 {
+		return fmt.Errorf("Invalid number of bitmap records: %d", sgFile.header.NumBitmapRecords)
+	}
+
+	sgFile.bitmaps = nil
+	sgFile.images = nil
 	err = sgFile.loadBitmaps(file)
 	if err != nil {
 		return err
 	}
 
-	_, err = file.Seek(int64(headerSize+sgFile.MaxBitmapRecords()*recordSize), 0)
+	if sgFile.lazy {
+		for _, bitmap := range sgFile.bitmaps {
+			bitmap.pending = true
+		}
+		return nil
+	}
+
+	_, err = file.Seek(sgFile.imageTableOffset(), 0)
 	if err != nil {
 		return err
 	}
 
-	err = sgFile.loadImages(file, sgFile.header.Version >= 0xd6)
+	err = sgFile.loadImages(file, size)
 	if err != nil {
 		return err
 	}
 
+	if sgFile.strict {
+		err = sgFile.checkImageTypes()
+		if err != nil {
+			return err
+		}
+	}
+
 	if len(sgFile.bitmaps) > 1 && len(sgFile.images) == sgFile.bitmaps[0].ImageCount() {
 		fmt.Printf("SG file has %d bitmaps but only the first is in use", len(sgFile.bitmaps))
 		// Remove the bitmaps other than the first
@@ -101,27 +338,29 @@ func (sgFile *SgFile) Load() error {
 
 func (sgFile *SgFile) loadBitmaps(r io.Reader) error {
 	for i := 0; i < int(sgFile.header.NumBitmapRecords); i++ {
-		bitmap, err := newSgBitmap(i, sgFile.filename, r)
+		bitmap, err := newSgBitmap(i, sgFile, r)
 		if err != nil {
 			return err
 		}
 		sgFile.bitmaps = append(sgFile.bitmaps, bitmap)
+		if sgFile.OnBitmapLoaded != nil {
+			sgFile.OnBitmapLoaded(i, bitmap)
+		}
 	}
 	return nil
 }
 
-func (sgFile *SgFile) loadImages(r io.Reader, includeAlpha bool) error {
-	newSgImage(0, r, includeAlpha)
+// The image table follows the full bitmap table. Enemy sg2 files only
+// differ from normal sg2 files in the number of image records, so they share
+// the same 680 + 100 * 200 byte offset. Non-standard files with more bitmaps
+// than the table normally holds have a larger table.
+func (sgFile *SgFile) imageTableOffset() int64 {
+	bitmapRecords := max(sgFile.MaxBitmapRecords(), int(sgFile.header.NumBitmapRecords))
+	return int64(headerSize + bitmapRecords*recordSize)
+}
 
-	for i := 0; i < int(sgFile.header.NumImageRecords); i++ {
-		image, err := newSgImage(i+1, r, includeAlpha)
-		if err != nil {
-			return err
-		}
-		invertOffset := image.InvertOffset()
-		if invertOffset < 0 && (i+int(invertOffset)) >= 0 {
-			image.SetInvertImage(sgFile.images[i+int(invertOffset)])
-		}
+func (sgFile *SgFile) loadImages(r io.Reader, size int64) error {
+	return sgFile.readImages(r, size, func(i int, image *SgImage) {
 		bitmapId := image.BitmapId()
 		if bitmapId >= 0 && bitmapId < len(sgFile.bitmaps) {
 			sgFile.bitmaps[bitmapId].AddImage(image)
@@ -130,29 +369,191 @@ func (sgFile *SgFile) loadImages(r io.Reader, includeAlpha bool) error {
 			fmt.Printf("Image %d has no parent: %d", i, bitmapId)
 		}
 		sgFile.images = append(sgFile.images, image)
+	})
+}
+
+// Reads the image records in the global range of the bitmap from the image
+// table of the file, for bitmaps whose loading was deferred by ReadFileLazy
+func (sgFile *SgFile) loadBitmapImages(bitmap *SgBitmap) error {
+	if bitmap.record.NumImages == 0 {
+		return nil
+	}
+	start, end := bitmap.GlobalRange()
+	last := int64(sgFile.header.NumImageRecords) + ReservedImageCount - 1
+	if start < ReservedImageCount || end < start || int64(end) > last {
+		return fmt.Errorf("Image range %d-%d of bitmap %d is outside the image table", start, end, bitmap.bitmapId)
+	}
+
+	includeAlpha := sgFile.header.Version >= 0xd6
+	return sgFile.withFile(func(file io.ReadSeeker, size int64) error {
+		recordSize := sgFile.imageRecordSize()
+		if _, err := file.Seek(sgFile.imageTableOffset()+int64(start)*recordSize, 0); err != nil {
+			return err
+		}
+		r := bufio.NewReader(file)
+		var images []*SgImage
+		for id := int(start); id <= int(end); id++ {
+			image, err := newSgImage(id, r, includeAlpha)
+			if err != nil {
+				return err
+			}
+			images = append(images, image)
+		}
+
+		// Images mirroring an image before the range read the record of
+		// that image on its own
+		for _, image := range images {
+			invertOffset := int(image.InvertOffset())
+			source := image.imageId + invertOffset
+			if invertOffset >= 0 || source < ReservedImageCount {
+				continue
+			}
+			if source >= int(start) {
+				image.SetInvertImage(images[source-int(start)])
+				continue
+			}
+			if _, err := file.Seek(sgFile.imageTableOffset()+int64(source)*recordSize, 0); err != nil {
+				return err
+			}
+			invert, err := newSgImage(source, file, includeAlpha)
+			if err != nil {
+				return err
+			}
+			image.SetInvertImage(invert)
+		}
+
+		for _, image := range images {
+			if image.BitmapId() == bitmap.bitmapId {
+				bitmap.AddImage(image)
+				image.SetParent(bitmap)
+			}
+		}
+		return nil
+	})
+}
+
+// Reads the image table of a file of size bytes and passes each image to
+// attach with its index, after linking it to the image it mirrors
+func (sgFile *SgFile) readImages(r io.Reader, size int64, attach func(i int, image *SgImage)) error {
+	if sgFile.header.NumImageRecords < 0 {
+		return fmt.Errorf("Invalid number of image records: %d", sgFile.header.NumImageRecords)
+	}
+	includeAlpha := sgFile.header.Version >= 0xd6
+
+	// Skip the reserved records, image ids start right after them
+	for i := 0; i < ReservedImageCount; i++ {
+		if _, err := newSgImage(i, r, includeAlpha); err != nil {
+			return fmt.Errorf("Unable to read reserved image record %d: %v", i, err)
+		}
+	}
+
+	// The count comes from the header, only trust it as far as the file
+	// can hold that many records
+	capacity := (size - sgFile.imageTableOffset()) / sgFile.imageRecordSize()
+	capacity = max(0, min(capacity, int64(sgFile.header.NumImageRecords)))
+	images := make([]*SgImage, 0, capacity)
+	for i := 0; i < int(sgFile.header.NumImageRecords); i++ {
+		image, err := newSgImage(i+ReservedImageCount, r, includeAlpha)
+		if err != nil {
+			return err
+		}
+		invertOffset := image.InvertOffset()
+		if invertOffset < 0 && (i+int(invertOffset)) >= 0 {
+			image.SetInvertImage(images[i+int(invertOffset)])
+		}
+		images = append(images, image)
+		attach(i, image)
 	}
 	return nil
 }
 
-func (sgFile *SgFile) checkVersion() bool {
+// Get the size of an image record, which only holds the alpha fields from
+// version 0xd6 on
+func (sgFile *SgFile) imageRecordSize() int64 {
+	if sgFile.header.Version >= 0xd6 {
+		return int64(binary.Size(SgImageRecord{}))
+	}
+	return int64(binary.Size(SgImageRecordNonAlpha{}))
+}
+
+// Returns an error listing the unsupported types used by images with data
+func (sgFile *SgFile) checkImageTypes() error {
+	counts := make(map[uint16]int)
+	for _, sgImage := range sgFile.images {
+		if sgImage.workRecord.Length > 0 && !sgImage.Type().Known() {
+			counts[sgImage.workRecord.Type]++
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+
+	types := make([]int, 0, len(counts))
+	for imageType := range counts {
+		types = append(types, int(imageType))
+	}
+	sort.Ints(types)
+	descriptions := make([]string, len(types))
+	for i, imageType := range types {
+		descriptions[i] = fmt.Sprintf("%d (%d images)", imageType, counts[uint16(imageType)])
+	}
+	return fmt.Errorf("Unsupported image types: %s", strings.Join(descriptions, ", "))
+}
+
+func (sgFile *SgFile) checkVersion(size int64) bool {
 	if sgFile.header.Version == 0xd3 {
 		// SG2 file: filesize = 74480 or 522680 (depending on whether it's
-		// a "normal" sg2 or an enemy sg2
+		// a "normal" sg2 or an enemy sg2). Both use the same record layout.
 		if sgFile.header.SgFilesize == 74480 || sgFile.header.SgFilesize == 522680 {
 			return true
 		}
 	} else if sgFile.header.Version == 0xd5 || sgFile.header.Version == 0xd6 {
-		fi, err := os.Stat(sgFile.filename)
-		if err != nil {
-			return false
-		}
-		if sgFile.header.SgFilesize == 74480 || int64(sgFile.header.SgFilesize) == fi.Size() {
+		if sgFile.header.SgFilesize == 74480 || int64(sgFile.header.SgFilesize) == size {
 			return true
 		}
 	}
 	return false
 }
 
+// Reads only the version field of the header of the sg file in r, to tell
+// sg2 files from sg3 files without loading them. Fails if the version isn't
+// one of the known sg versions.
+func Probe(r io.ReaderAt) (version uint32, isSG3 bool, err error) {
+	var buf [8]byte
+	if _, err := r.ReadAt(buf[:], 0); err != nil {
+		return 0, false, err
+	}
+	// The version follows the 4 byte file size field
+	version = binary.LittleEndian.Uint32(buf[4:])
+	switch version {
+	case 0xd3:
+		return version, false, nil
+	case 0xd5, 0xd6:
+		return version, true, nil
+	}
+	return version, false, fmt.Errorf("Incorrect sg version: 0x%x", version)
+}
+
+// Check the file and every bitmap of it and return the warnings found
+func (sgFile *SgFile) Verify() []string {
+	var warnings []string
+	if len(sgFile.bitmaps) > sgFile.MaxBitmapRecords() {
+		warnings = append(warnings, fmt.Sprintf("SG file has %d bitmaps, more than the usual maximum of %d", len(sgFile.bitmaps), sgFile.MaxBitmapRecords()))
+	}
+	for _, bitmap := range sgFile.bitmaps {
+		warnings = append(warnings, bitmap.Verify()...)
+	}
+	return warnings
+}
+
+// Get the palette used by paletted images of the file. None of the image
+// types known to this package are paletted (they all store 555 pixels) and
+// the sg formats read here have no palette section, so this always reports
+// that there is no palette.
+func (sgFile *SgFile) Palette() (color.Palette, bool) {
+	return nil, false
+}
+
 // Get the maximum number of bitmap records for this sg file
 func (sgFile *SgFile) MaxBitmapRecords() int {
 	if sgFile.header.Version == 0xd3 {
@@ -176,7 +577,59 @@ func (sgFile *SgFile) GetBitmap(bitmapId int) *SgBitmap {
 		return nil
 	}
 
-	return sgFile.bitmaps[bitmapId]
+	return sgFile.lazyBitmap(sgFile.bitmaps[bitmapId])
+}
+
+// Get the bitmap with the given name, compared case-insensitively and
+// without the ".bmp" extension, or nil if the file has no such bitmap
+func (sgFile *SgFile) BitmapByName(name string) *SgBitmap {
+	name = strings.TrimSuffix(strings.ToLower(name), ".bmp")
+	for _, bitmap := range sgFile.bitmaps {
+		if bitmap.BitmapName() == name {
+			return sgFile.lazyBitmap(bitmap)
+		}
+	}
+	return nil
+}
+
+// Get the names used by more than one bitmap, as compared by BitmapByName,
+// along with the ids of the bitmaps using them. The images of such bitmaps
+// would overwrite each other if exported by bitmap name alone.
+func (sgFile *SgFile) DuplicateBitmapNames() map[string][]int {
+	ids := make(map[string][]int)
+	for _, bitmap := range sgFile.bitmaps {
+		ids[bitmap.BitmapName()] = append(ids[bitmap.BitmapName()], bitmap.bitmapId)
+	}
+	for name, bitmapIds := range ids {
+		if len(bitmapIds) < 2 {
+			delete(ids, name)
+		}
+	}
+	return ids
+}
+
+// Load the images of a bitmap whose loading was deferred. The bitmap is
+// returned without images if they can't be read, with the error kept for
+// its Err method.
+func (sgFile *SgFile) lazyBitmap(bitmap *SgBitmap) *SgBitmap {
+	if bitmap.pending {
+		bitmap.pending = false
+		if err := sgFile.loadBitmapImages(bitmap); err != nil {
+			bitmap.images = nil
+			bitmap.loadErr = fmt.Errorf("Unable to load images of bitmap %d: %w", bitmap.bitmapId, err)
+		}
+	}
+	return bitmap
+}
+
+// Get the bitmap object within the data file, along with the error that
+// prevented its images from being read for files opened by ReadFileLazy
+func (sgFile *SgFile) LoadBitmap(bitmapId int) (*SgBitmap, error) {
+	bitmap := sgFile.GetBitmap(bitmapId)
+	if bitmap == nil {
+		return nil, fmt.Errorf("Bitmap id %d out of bounds (%d bitmaps)", bitmapId, len(sgFile.bitmaps))
+	}
+	return bitmap, bitmap.loadErr
 }
 
 // Get the name of the bitmap and the number of images
@@ -198,7 +651,156 @@ func (sgFile *SgFile) BitmapCount() int {
 	return len(sgFile.bitmaps)
 }
 
-// Get the number of images stored in the file
+// Get the number of images stored in the file, including orphan images that
+// aren't attached to a bitmap. The reserved records aren't counted, so for a
+// fully loaded file this is the NumImageRecords of the header.
 func (sgFile *SgFile) TotalImageCount() int {
 	return len(sgFile.images)
 }
+
+// Get the number of bytes the images of the file take up once decoded to
+// RGBA, to check the memory needed before decoding all of them.
+// Placeholder images without data and images without a bitmap aren't
+// counted, as they can't be decoded.
+func (sgFile *SgFile) TotalPixelBytes() int64 {
+	var total int64
+	for _, sgImage := range sgFile.images {
+		if sgImage.parent == nil || sgImage.checkRecord() != nil {
+			continue
+		}
+		total += int64(sgImage.workRecord.Width) * int64(sgImage.workRecord.Height) * 4
+	}
+	return total
+}
+
+// Get the number of image records declared by the header, excluding the
+// reserved image 0 record. This is read as is from the header, so unlike
+// TotalImageCount it is known for files opened by ReadFileLazy, and for
+// files whose image table is truncated it is the count Load failed to reach.
+func (sgFile *SgFile) DeclaredImageCount() int {
+	if sgFile.header == nil {
+		return 0
+	}
+	return int(sgFile.header.NumImageRecords)
+}
+
+// Iterate over the images of the file with their global index. Images are
+// always visited in the order of the image records in the file, so repeated
+// runs over the same file see the same sequence.
+func (sgFile *SgFile) Images() iter.Seq2[int, *SgImage] {
+	return func(yield func(int, *SgImage) bool) {
+		for i, sgImage := range sgFile.images {
+			if !yield(i, sgImage) {
+				return
+			}
+		}
+	}
+}
+
+// Iterate over the bitmaps of the file with their id, in file order
+func (sgFile *SgFile) Bitmaps() iter.Seq2[int, *SgBitmap] {
+	return func(yield func(int, *SgBitmap) bool) {
+		for i, bitmap := range sgFile.bitmaps {
+			if !yield(i, sgFile.lazyBitmap(bitmap)) {
+				return
+			}
+		}
+	}
+}
+
+// Get the images whose bitmap id doesn't match any bitmap of the file. They
+// are counted as images of the file but can't be decoded.
+func (sgFile *SgFile) OrphanImages() []*SgImage {
+	var orphans []*SgImage
+	for _, sgImage := range sgFile.images {
+		if sgImage.parent == nil {
+			orphans = append(orphans, sgImage)
+		}
+	}
+	return orphans
+}
+
+// Get the image at a global index across all bitmaps, counting images in
+// file order from 0. The reserved records aren't stored, so the global index
+// is ReservedImageCount less than the image id used by the game.
+func (sgFile *SgFile) ImageAt(globalIndex int) (*SgImage, error) {
+	if globalIndex < 0 || globalIndex >= len(sgFile.images) {
+		return nil, fmt.Errorf("Image index %d out of bounds (%d images)", globalIndex, len(sgFile.images))
+	}
+	return sgFile.images[globalIndex], nil
+}
+
+// Get the images with a global index from start up to, but not including,
+// end
+func (sgFile *SgFile) ImageRange(start, end int) ([]*SgImage, error) {
+	if start < 0 || start > end || end > len(sgFile.images) {
+		return nil, fmt.Errorf("Image range %d:%d out of bounds (%d images)", start, end, len(sgFile.images))
+	}
+	return append([]*SgImage(nil), sgFile.images[start:end]...), nil
+}
+
+// Get the first image of the file with visible content, to use as a
+// preview. Images of the system bitmap, placeholders without data and fully
+// transparent images are skipped.
+func (sgFile *SgFile) PreviewImage() (*image.RGBA, error) {
+	for _, bitmap := range sgFile.bitmaps {
+		if bitmap.isSystem() {
+			continue
+		}
+		for _, sgImage := range bitmap.images {
+			if sgImage.checkRecord() != nil {
+				continue
+			}
+			img, err := sgImage.GetImage()
+			if err != nil {
+				continue
+			}
+			for i := 3; i < len(img.Pix); i += 4 {
+				if img.Pix[i] != 0 {
+					return img, nil
+				}
+			}
+		}
+	}
+	return nil, errors.New("No image with visible content")
+}
+
+// Get the names of the .555 files needed to decode the images in the file:
+// the sg file's own .555 for internal images and the files named by the
+// bitmap records for external images
+func (sgFile *SgFile) RequiredDataFiles() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, sgImage := range sgFile.images {
+		if sgImage.parent == nil || sgImage.workRecord.Length == 0 {
+			continue
+		}
+		name := sgFile.baseFilename
+		if sgImage.IsExternal() {
+			name = sgImage.parent.record.filenameString()
+		}
+		name = dataFilename(name)
+		if !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Get the required data files that the data source can't provide, by
+// default those not found next to the sg file or in its 555 subdirectory
+func (sgFile *SgFile) CheckDataFiles() []string {
+	var missing []string
+	for _, name := range sgFile.RequiredDataFiles() {
+		reader, _, err := sgFile.dataSource.Open(name)
+		if err != nil {
+			missing = append(missing, name)
+			continue
+		}
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return missing
+}
@@ -0,0 +1,724 @@
+package sgreader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadMemory(t *testing.T) {
+	sgFile := sampleFixture(t)
+	if sgFile.BitmapCount() != 1 || sgFile.TotalImageCount() != 2 {
+		t.Fatalf("Got %d bitmaps and %d images, want 1 and 2", sgFile.BitmapCount(), sgFile.TotalImageCount())
+	}
+
+	sgImage, err := sgFile.ImageAt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		255, 0, 0, 255, 0, 255, 0, 255,
+		0, 0, 255, 255, 255, 255, 255, 255,
+	}
+	if pix := mustDecode(t, sgImage); !bytes.Equal(pix, want) {
+		t.Errorf("Got pixels %v, want %v", pix, want)
+	}
+}
+
+func TestReadMemoryMatchesDataCaseInsensitively(t *testing.T) {
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)},
+		[]SgImageRecord{{Length: 2, Width: 1, Height: 1}})
+	sgFile, err := ReadMemory(sg, map[string][]byte{"TEST.555": plainData(0x7fff)}, "test.sg3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustDecode(t, sgFile.GetBitmap(0).Image(0))
+}
+
+// Writes a file with the red image 1 in bitmap "a" and the blue image 2 in
+// bitmap "b" followed by image 3 mirroring it, to dir as test.sg3 and
+// test.555
+func writeLazyFixture(t *testing.T, dir string, bitmaps []SgBitmapRecord, gzipped bool) string {
+	t.Helper()
+	images := []SgImageRecord{
+		{Length: 2, Width: 1, Height: 1},
+		{Offset: 2, Length: 2, Width: 1, Height: 1, BitmapId: 1},
+		{InvertOffset: -1, BitmapId: 1},
+	}
+	sg := buildSG(t, versionSG3, bitmaps, images)
+	if gzipped {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(sg)
+		zw.Close()
+		sg = buf.Bytes()
+	}
+	filename := filepath.Join(dir, "test.sg3")
+	if err := os.WriteFile(filename, sg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "test.555"), plainData(0x7c00, 0x001f), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadFileLazyReadsOnlyAccessedBitmaps(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1), bitmapRecord("b.bmp", 2, 3)}
+	sgFile := ReadFileLazy(writeLazyFixture(t, t.TempDir(), bitmaps, false))
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	bitmap, err := sgFile.LoadBitmap(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bitmap.ImageCount() != 2 {
+		t.Fatalf("Got %d images, want 2", bitmap.ImageCount())
+	}
+	if !sgFile.bitmaps[0].pending || len(sgFile.bitmaps[0].images) != 0 {
+		t.Error("Read the images of a bitmap that wasn't accessed")
+	}
+	if pix := mustDecode(t, bitmap.Image(1)); !bytes.Equal(pix, []byte{0, 0, 255, 255}) {
+		t.Errorf("Got pixels %v for the mirrored image, want blue", pix)
+	}
+}
+
+func TestReadFileLazyKeepsDecompressedFile(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1), bitmapRecord("b.bmp", 2, 3)}
+	filename := writeLazyFixture(t, t.TempDir(), bitmaps, true)
+	sgFile := ReadFileLazy(filename)
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	bitmap, err := sgFile.LoadBitmap(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bitmap.ImageCount() != 2 {
+		t.Errorf("Got %d images, want 2", bitmap.ImageCount())
+	}
+}
+
+func TestReadFileLazyReportsLoadErrors(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1), bitmapRecord("b.bmp", 2, 9)}
+	sgFile := ReadFileLazy(writeLazyFixture(t, t.TempDir(), bitmaps, false))
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sgFile.LoadBitmap(1); err == nil {
+		t.Error("Loaded a bitmap whose range is past the image table")
+	}
+	bitmap := sgFile.GetBitmap(1)
+	if bitmap.Err() == nil {
+		t.Error("Err doesn't report the load failure")
+	}
+	if _, err := bitmap.GetImage(0); err == nil {
+		t.Error("GetImage doesn't report the load failure")
+	}
+}
+
+func TestLoadDoesNotTrustImageCount(t *testing.T) {
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, []SgImageRecord{{Length: 2, Width: 1, Height: 1}})
+	binary.LittleEndian.PutUint32(sg[16:], 0x7fffffff)
+	if _, err := ReadMemory(sg, map[string][]byte{"test.555": plainData(0x7fff)}, "test.sg3"); err == nil {
+		t.Error("Loaded a file declaring more image records than it holds")
+	}
+}
+
+func TestDeclaredImageCount(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1), bitmapRecord("b.bmp", 2, 3)}
+	filename := writeLazyFixture(t, t.TempDir(), bitmaps, false)
+
+	lazy := ReadFileLazy(filename)
+	if err := lazy.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if lazy.DeclaredImageCount() != 3 || lazy.TotalImageCount() != 0 {
+		t.Errorf("Got %d declared and %d loaded images for a lazy file, want 3 and 0", lazy.DeclaredImageCount(), lazy.TotalImageCount())
+	}
+
+	// Cut the file in the middle of the third image record
+	sg, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sg = sg[:len(sg)-10]
+	binary.LittleEndian.PutUint32(sg, uint32(len(sg)))
+	if err := os.WriteFile(filename, sg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	truncated := ReadFile(filename)
+	if err := truncated.Load(); err == nil {
+		t.Fatal("Loaded a truncated image table")
+	}
+	if truncated.DeclaredImageCount() != 3 || truncated.TotalImageCount() != 2 {
+		t.Errorf("Got %d declared and %d loaded images for a truncated file, want 3 and 2", truncated.DeclaredImageCount(), truncated.TotalImageCount())
+	}
+}
+
+func TestReadMetadata(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1), bitmapRecord("b.bmp", 2, 3)}
+	filename := writeLazyFixture(t, t.TempDir(), bitmaps, false)
+	header, records, err := ReadMetadata(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sgFile := ReadFile(filename)
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if *header != *sgFile.header {
+		t.Errorf("Got header %+v, want %+v", *header, *sgFile.header)
+	}
+	if len(records) != sgFile.BitmapCount() {
+		t.Fatalf("Got %d bitmap records, want %d", len(records), sgFile.BitmapCount())
+	}
+	for i, record := range records {
+		if record != *sgFile.bitmaps[i].record {
+			t.Errorf("Bitmap record %d differs from the loaded one", i)
+		}
+	}
+}
+
+func TestReadMetadataRejectsHugeBitmapCount(t *testing.T) {
+	filename := writeLazyFixture(t, t.TempDir(), []SgBitmapRecord{bitmapRecord("a.bmp", 1, 3)}, false)
+	sg, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(sg[20:], 0x7fffffff)
+	if err := os.WriteFile(filename, sg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ReadMetadata(filename); err == nil {
+		t.Error("Read more bitmap records than the file holds")
+	}
+}
+
+func TestHeaderFitsHeaderSize(t *testing.T) {
+	if size := binary.Size(SgHeader{}); size > headerSize {
+		t.Fatalf("SgHeader takes %d bytes, more than the %d byte header", size, headerSize)
+	}
+	// The bitmap records start right after the header
+	if name := sampleFixture(t).GetBitmap(0).FileName(); name != "Sample.bmp" {
+		t.Errorf("Got bitmap name %q, want Sample.bmp", name)
+	}
+}
+
+func TestRequiredDataFiles(t *testing.T) {
+	names := exportFixture(t).RequiredDataFiles()
+	if want := []string{"test.555", "ext.555"}; !slices.Equal(names, want) {
+		t.Errorf("Got %v, want %v", names, want)
+	}
+}
+
+func TestCheckDataFiles(t *testing.T) {
+	missing := exportFixture(t).CheckDataFiles()
+	if want := []string{"ext.555"}; !slices.Equal(missing, want) {
+		t.Errorf("Got missing files %v, want %v", missing, want)
+	}
+	if missing := sampleFixture(t).CheckDataFiles(); len(missing) != 0 {
+		t.Errorf("Got missing files %v, want none", missing)
+	}
+}
+
+func TestImageRange(t *testing.T) {
+	sgFile := sampleFixture(t)
+	images, err := sgFile.ImageRange(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ImageId() != 2 {
+		t.Errorf("Got %v, want image 2", images)
+	}
+	images, err = sgFile.GetBitmap(0).ImageRange(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ImageId() != 1 {
+		t.Errorf("Got %v, want image 1", images)
+	}
+
+	for _, r := range [][2]int{{-1, 1}, {1, 0}, {0, 3}} {
+		if _, err := sgFile.ImageRange(r[0], r[1]); err == nil {
+			t.Errorf("Got images %d:%d of 2 images", r[0], r[1])
+		}
+		if _, err := sgFile.GetBitmap(0).ImageRange(r[0], r[1]); err == nil {
+			t.Errorf("Got bitmap images %d:%d of 2 images", r[0], r[1])
+		}
+	}
+}
+
+func TestImageRecordCounts(t *testing.T) {
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 0, 0)}, nil)
+	sgFile, err := ReadMemory(sg, nil, "test.sg3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sgFile.TotalImageCount() != 0 {
+		t.Errorf("Got %d images, want 0", sgFile.TotalImageCount())
+	}
+
+	binary.LittleEndian.PutUint32(sg[16:], 0xffffffff)
+	if _, err := ReadMemory(sg, nil, "test.sg3"); err == nil {
+		t.Error("Loaded a file with -1 image records")
+	}
+}
+
+func TestLoadTruncatedAtReservedRecord(t *testing.T) {
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 0, 0)}, nil)
+	sg = sg[:len(sg)-binary.Size(SgImageRecord{})]
+	binary.LittleEndian.PutUint32(sg, uint32(len(sg)))
+	_, err := ReadMemory(sg, nil, "test.sg3")
+	if err == nil || !strings.Contains(err.Error(), "reserved image record") {
+		t.Errorf("Got error %v, want one about the reserved record", err)
+	}
+}
+
+func TestIterationFollowsFileOrder(t *testing.T) {
+	load := func() *SgFile {
+		bitmaps := []SgBitmapRecord{bitmapRecord("b.bmp", 1, 2), bitmapRecord("a.bmp", 3, 4)}
+		images := []SgImageRecord{
+			{Length: 2, Width: 1, Height: 1},
+			{Length: 2, Width: 1, Height: 1},
+			{Length: 2, Width: 1, Height: 1, BitmapId: 1},
+			{Length: 2, Width: 1, Height: 1, BitmapId: 1},
+		}
+		return loadFixture(t, bitmaps, images, plainData(0x7fff))
+	}
+
+	var runs [2][]string
+	for i := range runs {
+		sgFile := load()
+		for index, sgImage := range sgFile.Images() {
+			if sgImage.ImageId() != index+1 {
+				t.Errorf("Got image %d at index %d", sgImage.ImageId(), index)
+			}
+		}
+		rows, err := sgFile.SpriteRows(WriteOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			runs[i] = append(runs[i], row.Filename)
+		}
+	}
+	want := []string{"b_00001.png", "b_00002.png", "a_00001.png", "a_00002.png"}
+	if !slices.Equal(runs[0], want) || !slices.Equal(runs[1], want) {
+		t.Errorf("Got filenames %v and %v, want %v", runs[0], runs[1], want)
+	}
+}
+
+func TestPreviewImageSkipsSystemAndPlaceholders(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("System.bmp", 1, 1), bitmapRecord("a.bmp", 2, 4)}
+	images := []SgImageRecord{
+		{Length: 2, Width: 1, Height: 1},
+		{Width: 1, Height: 1, BitmapId: 1},
+		{Offset: 2, Length: 2, Width: 1, Height: 1, BitmapId: 1},
+		{Offset: 4, Length: 2, Width: 1, Height: 1, BitmapId: 1},
+	}
+	// The first image of "a" with data is fully transparent
+	sgFile := loadFixture(t, bitmaps, images, plainData(0x7fff, 0xf81f, 0x001f))
+
+	img, err := sgFile.PreviewImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0, 255, 255}; !bytes.Equal(img.Pix, want) {
+		t.Errorf("Got preview %v, want %v", img.Pix, want)
+	}
+}
+
+func TestPreviewImageWithoutContent(t *testing.T) {
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, []SgImageRecord{{Width: 1, Height: 1}}, nil)
+	if _, err := sgFile.PreviewImage(); err == nil {
+		t.Error("Got a preview of a file with only placeholders")
+	}
+}
+
+func TestOrphanImages(t *testing.T) {
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Length: 2, Width: 1, Height: 1, BitmapId: 7}}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, images, plainData(0x7fff))
+
+	orphans := sgFile.OrphanImages()
+	if len(orphans) != 1 || orphans[0].ImageId() != 2 {
+		t.Fatalf("Got orphans %v, want image 2", orphans)
+	}
+	if _, err := orphans[0].GetImage(); !errors.Is(err, ErrNoParent) {
+		t.Errorf("Got error %v, want ErrNoParent", err)
+	}
+}
+
+func TestStrictModeRejectsUnknownTypes(t *testing.T) {
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Length: 2, Width: 1, Height: 1, Type: 99}}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 2)}, images, plainData(0x7fff))
+	mustDecode(t, sgFile.GetBitmap(0).Image(0))
+
+	sgFile.SetStrict(true)
+	err := sgFile.Load()
+	if err == nil || !strings.Contains(err.Error(), "99") {
+		t.Errorf("Got error %v, want one naming type 99", err)
+	}
+}
+
+func TestSetDataRoot(t *testing.T) {
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, []SgImageRecord{{Length: 2, Width: 1, Height: 1}})
+	sgDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sgDir, "test.sg3"), sg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sub := range []string{"", "555"} {
+		dataRoot := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dataRoot, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dataRoot, sub, "test.555"), plainData(0x7fff), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		sgFile := ReadFile(filepath.Join(sgDir, "test.sg3"))
+		if err := sgFile.Load(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sgFile.GetBitmap(0).GetImage(0); err == nil {
+			t.Error("Found the data file outside the directory of the sg file")
+		}
+		if err := sgFile.SetDataRoot(dataRoot); err != nil {
+			t.Fatal(err)
+		}
+		mustDecode(t, sgFile.GetBitmap(0).Image(0))
+
+		// An empty root goes back to the directory of the sg file
+		if err := sgFile.SetDataRoot(""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sgFile.GetBitmap(0).GetImage(0); err == nil {
+			t.Error("Still reading the data root after resetting it")
+		}
+	}
+}
+
+func TestImageAt(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 2), bitmapRecord("b.bmp", 3, 5)}
+	var images []SgImageRecord
+	for i := 0; i < 5; i++ {
+		images = append(images, SgImageRecord{Length: 2, Width: 1, Height: 1, BitmapId: uint8(min(i/2, 1))})
+	}
+	sgFile := loadFixture(t, bitmaps, images, plainData(0x7fff))
+
+	tests := []struct {
+		index int
+		want  ImageRef
+	}{
+		{0, ImageRef{Bitmap: "a", BitmapId: 0, Index: 0}},
+		{1, ImageRef{Bitmap: "a", BitmapId: 0, Index: 1}},
+		{2, ImageRef{Bitmap: "b", BitmapId: 1, Index: 0}},
+		{4, ImageRef{Bitmap: "b", BitmapId: 1, Index: 2}},
+	}
+	for _, test := range tests {
+		sgImage, err := sgFile.ImageAt(test.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref := sgImage.Ref(); ref != test.want {
+			t.Errorf("Got %+v at index %d, want %+v", ref, test.index, test.want)
+		}
+		// Image ids count the reserved record
+		if sgImage.ImageId() != test.index+1 {
+			t.Errorf("Got image id %d at index %d, want %d", sgImage.ImageId(), test.index, test.index+1)
+		}
+	}
+	for _, index := range []int{-1, 5} {
+		if _, err := sgFile.ImageAt(index); err == nil {
+			t.Errorf("Got an image at index %d", index)
+		}
+	}
+}
+
+func TestEnemySG2Layout(t *testing.T) {
+	data := plainData(0x7c00, 0x001f)
+	spriteOffset := len(data)
+	data = append(data, 255, 1, 1)
+	data = append(data, plainData(0x7fff)...)
+	images := []SgImageRecord{
+		{Length: 4, Width: 2, Height: 1},
+		{Offset: uint32(spriteOffset), Length: uint32(len(data) - spriteOffset), Width: 2, Height: 1, Type: uint16(TypeSprite)},
+	}
+	sg := buildSG(t, versionSG2, []SgBitmapRecord{bitmapRecord("Barbarian.bmp", 1, 2)}, images)
+	// Enemy files only differ from other sg2 files by the size in the header
+	binary.LittleEndian.PutUint32(sg, 522680)
+
+	sgFile, err := ReadMemory(sg, map[string][]byte{"enemy.555": data}, "enemy.sg2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sgFile.BitmapCount() != 1 || sgFile.TotalImageCount() != 2 {
+		t.Fatalf("Got %d bitmaps and %d images, want 1 and 2", sgFile.BitmapCount(), sgFile.TotalImageCount())
+	}
+	tests := [][]byte{
+		{255, 0, 0, 255, 0, 0, 255, 255},
+		{0, 0, 0, 0, 255, 255, 255, 255},
+	}
+	for i, want := range tests {
+		if pix := mustDecode(t, sgFile.GetBitmap(0).Image(i)); !bytes.Equal(pix, want) {
+			t.Errorf("Got pixels %v for image %d, want %v", pix, i, want)
+		}
+	}
+}
+
+func TestOnBitmapLoaded(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1), bitmapRecord("b.bmp", 2, 2), bitmapRecord("c.bmp", 3, 3)}
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Length: 2, Width: 1, Height: 1, BitmapId: 1}, {Length: 2, Width: 1, Height: 1, BitmapId: 2}}
+	sgFile := loadFixture(t, bitmaps, images, plainData(0x7fff))
+
+	var names []string
+	sgFile.OnBitmapLoaded = func(index int, b *SgBitmap) {
+		if index != len(names) {
+			t.Errorf("Got bitmap %d after %d bitmaps", index, len(names))
+		}
+		names = append(names, b.BitmapName())
+	}
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != sgFile.BitmapCount() || !slices.Equal(names, []string{"a", "b", "c"}) {
+		t.Errorf("Got bitmaps %v, want a, b and c", names)
+	}
+}
+
+func TestPaletteNotPresent(t *testing.T) {
+	if palette, ok := sampleFixture(t).Palette(); ok || palette != nil {
+		t.Errorf("Got palette %v, want none", palette)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		version uint32
+		isSG3   bool
+	}{
+		{versionSG2, false},
+		{versionSG3, true},
+	}
+	for _, test := range tests {
+		sg := buildSG(t, test.version, nil, nil)
+		version, isSG3, err := Probe(bytes.NewReader(sg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != test.version || isSG3 != test.isSG3 {
+			t.Errorf("Got version 0x%x sg3 %v, want 0x%x sg3 %v", version, isSG3, test.version, test.isSG3)
+		}
+	}
+
+	if _, _, err := Probe(bytes.NewReader(make([]byte, 8))); err == nil {
+		t.Error("Probed a file of version 0")
+	}
+	if _, _, err := Probe(bytes.NewReader(nil)); err == nil {
+		t.Error("Probed an empty file")
+	}
+}
+
+func TestReadFileAtSkipsPrefix(t *testing.T) {
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, []SgImageRecord{{Length: 2, Width: 1, Height: 1}})
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.sg3")
+	if err := os.WriteFile(filename, append([]byte("JUNKJUNK"), sg...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "test.555"), plainData(0x7fff), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReadFile(filename).Load(); err == nil {
+		t.Error("Loaded a file with junk before the header")
+	}
+	sgFile := ReadFileAt(filename, 8)
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{255, 255, 255, 255}; !bytes.Equal(mustDecode(t, sgFile.GetBitmap(0).Image(0)), want) {
+		t.Error("Image after the prefix doesn't decode to white")
+	}
+}
+
+func TestReadGzipCompressedFiles(t *testing.T) {
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		return buf.Bytes()
+	}
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Offset: 2, Length: 2, Width: 1, Height: 1}}
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 2)}, images)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "test.sg3"), gzipped(sg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "test.555"), gzipped(plainData(0x7c00, 0x001f)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sgFile := ReadFile(filepath.Join(dir, "test.sg3"))
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0, 255, 255}; !bytes.Equal(mustDecode(t, sgFile.GetBitmap(0).Image(1)), want) {
+		t.Error("Image of the compressed data file isn't blue")
+	}
+}
+
+func TestBitmapsIterator(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1), bitmapRecord("b.bmp", 2, 2), bitmapRecord("c.bmp", 3, 3)}
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Length: 2, Width: 1, Height: 1, BitmapId: 1}, {Length: 2, Width: 1, Height: 1, BitmapId: 2}}
+	sgFile := loadFixture(t, bitmaps, images, plainData(0x7fff))
+
+	count := 0
+	for id, bitmap := range sgFile.Bitmaps() {
+		if bitmap != sgFile.GetBitmap(id) {
+			t.Errorf("Got a different bitmap for id %d", id)
+		}
+		count++
+	}
+	if count != sgFile.BitmapCount() {
+		t.Errorf("Iterated over %d bitmaps, want %d", count, sgFile.BitmapCount())
+	}
+
+	count = 0
+	for range sgFile.Bitmaps() {
+		count++
+		break
+	}
+	if count != 1 {
+		t.Errorf("Iterated over %d bitmaps after a break, want 1", count)
+	}
+}
+
+func TestMoreBitmapsThanMaximum(t *testing.T) {
+	var bitmaps []SgBitmapRecord
+	for i := 0; i < 201; i++ {
+		bitmaps = append(bitmaps, bitmapRecord(fmt.Sprintf("b%d.bmp", i), uint32(i+1), uint32(i+1)))
+	}
+	var images []SgImageRecord
+	for i := range bitmaps {
+		images = append(images, SgImageRecord{Offset: uint32(2 * (i % 2)), Length: 2, Width: 1, Height: 1, BitmapId: uint8(i)})
+	}
+	sgFile := loadFixture(t, bitmaps, images, plainData(0x7c00, 0x001f))
+
+	if sgFile.BitmapCount() != 201 || sgFile.TotalImageCount() != 201 {
+		t.Fatalf("Got %d bitmaps and %d images, want 201 of each", sgFile.BitmapCount(), sgFile.TotalImageCount())
+	}
+	// The image table follows all 201 bitmap records
+	bitmap := sgFile.GetBitmap(200)
+	if bitmap.ImageCount() != 1 {
+		t.Fatalf("Got %d images in the last bitmap, want 1", bitmap.ImageCount())
+	}
+	if want := []byte{255, 0, 0, 255}; !bytes.Equal(mustDecode(t, bitmap.Image(0)), want) {
+		t.Error("Image of the last bitmap isn't red")
+	}
+	if warnings := sgFile.Verify(); !slices.Contains(warnings, "SG file has 201 bitmaps, more than the usual maximum of 200") {
+		t.Errorf("Got warnings %q, want the bitmap count reported", warnings)
+	}
+}
+
+func TestDuplicateBitmapNames(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1), bitmapRecord("B.bmp", 2, 2), bitmapRecord("c.bmp", 3, 3), bitmapRecord("b.bmp", 4, 4)}
+	var images []SgImageRecord
+	for i := range bitmaps {
+		images = append(images, SgImageRecord{Length: 2, Width: 1, Height: 1, BitmapId: uint8(i)})
+	}
+	sgFile := loadFixture(t, bitmaps, images, plainData(0x7fff))
+
+	duplicates := sgFile.DuplicateBitmapNames()
+	if len(duplicates) != 1 || !slices.Equal(duplicates["b"], []int{1, 3}) {
+		t.Errorf("Got duplicates %v, want b used by bitmaps 1 and 3", duplicates)
+	}
+}
+
+func TestDataFileFallback(t *testing.T) {
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, []SgImageRecord{{Length: 2, Width: 1, Height: 1}})
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.sg3")
+	if err := os.WriteFile(filename, sg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Other.555"), plainData(0x7fff), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sgFile := ReadFile(filename)
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sgFile.GetBitmap(0).GetImage(0); !errors.Is(err, ErrDataNotFound) {
+		t.Errorf("Got error %v without the fallback, want ErrDataNotFound", err)
+	}
+	if err := sgFile.SetDataFileFallback(true); err != nil {
+		t.Fatal(err)
+	}
+	mustDecode(t, sgFile.GetBitmap(0).Image(0))
+
+	// The fallback is ambiguous with a second .555 file
+	if err := os.WriteFile(filepath.Join(dir, "third.555"), plainData(0x7fff), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sgFile = ReadFile(filename)
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	sgFile.SetDataFileFallback(true)
+	if _, err := sgFile.GetBitmap(0).GetImage(0); !errors.Is(err, ErrDataNotFound) {
+		t.Errorf("Got error %v with two data files, want ErrDataNotFound", err)
+	}
+}
+
+func TestTotalPixelBytes(t *testing.T) {
+	images := []SgImageRecord{
+		{Length: 8, Width: 2, Height: 2},
+		{Length: 12, Width: 3, Height: 2},
+		{Width: 5, Height: 5},
+		{Length: 2, Width: 7, Height: 7, BitmapId: 4},
+	}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 3)}, images, plainData(0x7fff))
+
+	// The placeholder and the orphan aren't counted
+	var want int64
+	for _, sgImage := range sgFile.GetBitmap(0).images[:2] {
+		want += int64(sgImage.workRecord.Width) * int64(sgImage.workRecord.Height) * 4
+	}
+	if total := sgFile.TotalPixelBytes(); total != want || want != 40 {
+		t.Errorf("Got %d bytes, want %d", total, want)
+	}
+}
+
+func TestImageNumberingMatchesHeader(t *testing.T) {
+	sgFile := sampleFixture(t)
+	declared := int(sgFile.header.NumImageRecords)
+	if sgFile.TotalImageCount() != declared || sgFile.DeclaredImageCount() != declared {
+		t.Errorf("Got %d images and %d declared, want %d", sgFile.TotalImageCount(), sgFile.DeclaredImageCount(), declared)
+	}
+	// The last image has the highest id the game uses for the file
+	last, err := sgFile.ImageAt(declared - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.ImageId() != declared-1+ReservedImageCount {
+		t.Errorf("Got id %d for the last image, want %d", last.ImageId(), declared-1+ReservedImageCount)
+	}
+}
@@ -2,12 +2,16 @@ package sgreader
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"image"
 	"image/color"
 	"image/draw"
 	"io"
+	"log"
+	"strings"
 )
 
 const (
@@ -19,6 +23,10 @@ const (
 	ISOMETRIC_LARGE_TILE_BYTES  = 3200
 )
 
+const (
+	hexDumpLength int = 64
+)
+
 type SgImageRecord struct {
 	Offset             uint32
 	Length             uint32
@@ -80,13 +88,40 @@ func newImageRecord(r io.Reader, includeAlpha bool) (*SgImageRecord, error) {
 	return record.convert(), nil
 }
 
+// ErrNoParent is returned when decoding an image that isn't attached to a
+// bitmap, so its data file is unknown
+var ErrNoParent = errors.New("Image has no bitmap parent")
+
+// ErrDataFileEmpty is returned when the .555 file holding the image data
+// exists but is empty, as opposed to the file not being found
+var ErrDataFileEmpty = errors.New("Data file is empty")
+
+// ErrDataNotFound is returned when the .555 file holding the image data
+// can't be found, whether the file or its directory is missing. The
+// specific cause is wrapped along with it.
+var ErrDataNotFound = errors.New("Data file not found")
+
+// ErrOffsetOutOfRange is returned when the image record points at data past
+// the end of the .555 file, which usually means the record is corrupt
+var ErrOffsetOutOfRange = errors.New("Image data out of range")
+
 // SgImage stores the metadata of the image
 type SgImage struct {
-	record     *SgImageRecord
-	workRecord *SgImageRecord
-	parent     *SgBitmap
-	invert     bool
-	imageId    int
+	record       *SgImageRecord
+	workRecord   *SgImageRecord
+	parent       *SgBitmap
+	invertSource *SgImage
+	invert       bool
+	imageId      int
+	localIndex   int
+}
+
+// ImageRef identifies an image by the name of its bitmap and its index
+// within that bitmap. The bitmap id tells apart bitmaps sharing a name.
+type ImageRef struct {
+	Bitmap   string
+	BitmapId int
+	Index    int
 }
 
 func newSgImage(id int, r io.Reader, includeAlpha bool) (*SgImage, error) {
@@ -112,6 +147,38 @@ func (sgImage *SgImage) InvertOffset() int32 {
 	return sgImage.record.InvertOffset
 }
 
+// The id of the image as used by the game, which counts the reserved
+// records at the start of the image table. See ReservedImageCount.
+func (sgImage *SgImage) ImageId() int {
+	return sgImage.imageId
+}
+
+// The position of the image within its parent bitmap, as opposed to the
+// global image id
+func (sgImage *SgImage) LocalIndex() int {
+	return sgImage.localIndex
+}
+
+// Get a human readable label for the image, made of the bitmap name and the
+// local index such as "plateau #12". The sg formats don't store labels for
+// single images. Images without a bitmap are labelled by their image id.
+func (sgImage *SgImage) Label() string {
+	if sgImage.parent == nil {
+		return fmt.Sprintf("image %d", sgImage.imageId)
+	}
+	return fmt.Sprintf("%s #%d", sgImage.parent.BitmapName(), sgImage.localIndex)
+}
+
+// Get the reference of the image, the bitmap name is empty when the image
+// has no parent bitmap
+func (sgImage *SgImage) Ref() ImageRef {
+	ref := ImageRef{BitmapId: sgImage.BitmapId(), Index: sgImage.localIndex}
+	if sgImage.parent != nil {
+		ref.Bitmap = sgImage.parent.BitmapName()
+	}
+	return ref
+}
+
 // The ID of the image within the bitmap
 func (sgImage *SgImage) BitmapId() int {
 	if sgImage.workRecord != nil {
@@ -120,6 +187,25 @@ func (sgImage *SgImage) BitmapId() int {
 	return int(sgImage.record.BitmapId)
 }
 
+// The number of bytes the image data takes up in the .555 file
+func (sgImage *SgImage) StorageSize() int {
+	return int(sgImage.workRecord.Length) + int(sgImage.workRecord.AlphaLength)
+}
+
+// Get the image data as stored in the .555 file, StorageSize bytes holding
+// the compressed pixels followed by the alpha mask, to copy images between
+// files without decoding them. Like GetImage, a data file that is exactly 4
+// bytes short has the missing bytes filled with zeroes.
+func (sgImage *SgImage) RawData() ([]byte, error) {
+	return sgImage.fillBuffer(DecodeOptions{})
+}
+
+// Reports whether the image data is stored in the external .555 file named
+// by the bitmap record rather than the .555 file of the sg file
+func (sgImage *SgImage) IsExternal() bool {
+	return sgImage.workRecord.Flags[0] != 0
+}
+
 // Returns the width and height of this image
 func (sgImage *SgImage) String() string {
 	return fmt.Sprintf("%dx%d", int(sgImage.workRecord.Width), int(sgImage.workRecord.Height))
@@ -128,14 +214,20 @@ func (sgImage *SgImage) String() string {
 // Returns the full information of this image
 func (sgImage *SgImage) FullDescription() string {
 	flag := "internal"
-	if sgImage.workRecord.Flags[0] != 0 {
+	if sgImage.IsExternal() {
 		flag = "external"
 	}
-	return fmt.Sprintf("ID %d: offset %d, length %d, width %d, height %d, type %d, %s", sgImage.imageId, sgImage.workRecord.Offset, sgImage.workRecord.Length, sgImage.workRecord.Width, sgImage.workRecord.Height, sgImage.workRecord.Type, flag)
+	return fmt.Sprintf("ID %d: offset %d, length %d, width %d, height %d, type %d (%s), %s", sgImage.imageId, sgImage.workRecord.Offset, sgImage.workRecord.Length, sgImage.workRecord.Width, sgImage.workRecord.Height, sgImage.workRecord.Type, sgImage.Type(), flag)
+}
+
+// The type of the image, which determines how its data is decoded
+func (sgImage *SgImage) Type() ImageType {
+	return ImageType(sgImage.workRecord.Type)
 }
 
 // Set the work record of the inverted image
 func (sgImage *SgImage) SetInvertImage(invert *SgImage) {
+	sgImage.invertSource = invert
 	sgImage.workRecord = invert.record
 }
 
@@ -144,92 +236,613 @@ func (sgImage *SgImage) SetParent(parent *SgBitmap) {
 	sgImage.parent = parent
 }
 
-// Get the image.RGBA object for this image
+// DecodeOptions changes how an image is decoded
+type DecodeOptions struct {
+	// Skip the stored alpha mask, leaving every drawn pixel opaque
+	IgnoreAlpha bool
+	// Pad image data missing from a truncated data file with zeroes instead
+	// of failing, to salvage the rest of the image. Padded images are
+	// reported to Logger.
+	AllowShortData bool
+	// Draw only the overlay of isometric images whose footprint doesn't match
+	// a known tile size, instead of failing. Skipped footprints are reported
+	// to Logger.
+	SkipInvalidBase bool
+	// Reverse the order of the rows, putting the origin at the bottom left
+	// as OpenGL expects for textures. Applied after the horizontal mirroring
+	// of inverted images.
+	FlipVertical bool
+	// Paint the pixels keyed out by the transparent color in this color
+	// instead of leaving them transparent, to show which pixels were keyed
+	// out when looking for decoding errors
+	DebugTransparent *color.RGBA
+	// Blend the image over this color, producing an opaque image for
+	// engines that can't handle transparency
+	Background *color.RGBA
+	// Receives the warnings about images decoded despite damaged data, which
+	// are discarded when nil. Concurrent decodes may share a logger.
+	Logger *log.Logger
+}
+
+// Reports a warning to the logger of the options, if any
+func (opts DecodeOptions) warnf(format string, args ...any) {
+	if opts.Logger != nil {
+		opts.Logger.Printf(format, args...)
+	}
+}
+
+// Get the image.RGBA object for this image. As with any image.RGBA the
+// colors of pixels with an alpha mask are premultiplied by their alpha, so
+// callers that want straight alpha must convert them with color.NRGBAModel.
 func (sgImage *SgImage) GetImage() (*image.RGBA, error) {
+	return sgImage.Decode(DecodeOptions{})
+}
+
+// Get the image.RGBA object for this image, decoded according to opts
+func (sgImage *SgImage) Decode(opts DecodeOptions) (*image.RGBA, error) {
 	if sgImage.parent == nil {
-		return nil, errors.New("Image has no bitmap parent")
+		return nil, ErrNoParent
+	}
+	if err := sgImage.checkRecord(); err != nil {
+		return nil, err
+	}
+
+	// Only images decoded with the default options are cached
+	cache := sgImage.parent.sgFile.imageCache
+	if cache != nil && opts == (DecodeOptions{}) {
+		if img, ok := cache.get(sgImage.imageId); ok {
+			return img, nil
+		}
+	}
+
+	buffer, err := sgImage.fillBuffer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := sgImage.decode(buffer, opts)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil && opts == (DecodeOptions{}) {
+		cache.put(sgImage.imageId, img)
+	}
+	return img, nil
+}
+
+// Decodes an image directly from the data file, using rec to describe the
+// image data stored at offset. This allows recovering images from a file
+// whose record table is damaged while the data itself is intact.
+func DecodeAt(r io.ReaderAt, offset int64, rec SgImageRecord) (*image.RGBA, error) {
+	sgImage := &SgImage{record: &rec, workRecord: &rec}
+	if err := sgImage.checkRecord(); err != nil {
+		return nil, err
+	}
+
+	// The size of r is unknown, so the data is read without allocating the
+	// declared length up front: a corrupt record may declare gigabytes
+	length := int64(rec.Length) + int64(rec.AlphaLength)
+	buffer, err := io.ReadAll(io.NewSectionReader(r, offset, length))
+	if int64(len(buffer)) != length {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("Unable to read %d bytes at offset %d: %v", length, offset, err)
 	}
+
+	return sgImage.decode(buffer, DecodeOptions{})
+}
+
+// Check the image record the way GetImage does before decoding, without
+// reading any image data: the image must have a positive size, image data
+// and a type that can be decoded. The image data itself may still turn out
+// to be invalid.
+func (sgImage *SgImage) Valid() error {
+	if err := sgImage.checkRecord(); err != nil {
+		return err
+	}
+	if !sgImage.Type().Known() {
+		return fmt.Errorf("Unknown image type: %d", sgImage.workRecord.Type)
+	}
+	return nil
+}
+
+func (sgImage *SgImage) checkRecord() error {
 	if sgImage.workRecord.Width <= 0 || sgImage.workRecord.Height <= 0 {
-		return nil, fmt.Errorf("Width or height invalid (%dx%d)", sgImage.workRecord.Width, sgImage.workRecord.Height)
+		return fmt.Errorf("Width or height invalid (%dx%d)", sgImage.workRecord.Width, sgImage.workRecord.Height)
 	} else if sgImage.workRecord.Length <= 0 {
-		return nil, errors.New("No image data available")
+		return errors.New("No image data available")
 	}
+	return nil
+}
 
-	buffer, err := sgImage.fillBuffer()
+// Decodes the image data read from the data file
+func (sgImage *SgImage) decode(buffer []byte, opts DecodeOptions) (*image.RGBA, error) {
+	pixels, err := sgImage.decode555(buffer, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	result := image.NewRGBA(image.Rect(0, 0, int(sgImage.workRecord.Width), int(sgImage.workRecord.Height)))
+	result := image.NewRGBA(pixels.Bounds())
 	// Initialize image to transparent black
 	draw.Draw(result, result.Bounds(), &image.Uniform{color.RGBA{0, 0, 0, 0}}, image.ZP, draw.Src)
+	for y := 0; y < pixels.height; y++ {
+		for x := 0; x < pixels.width; x++ {
+			c := pixels.at(x, y)
+			if c == transparent555 && opts.DebugTransparent != nil {
+				result.SetRGBA(x, y, *opts.DebugTransparent)
+				continue
+			}
+			sgImage.set555Pixel(result, x, y, c)
+		}
+	}
+
+	if sgImage.workRecord.AlphaLength > 0 && !opts.IgnoreAlpha {
+		if int64(sgImage.workRecord.Length) > int64(len(buffer)) {
+			return nil, errors.New("Image data length exceeds available data")
+		}
+		alphaBuffer := buffer[sgImage.workRecord.Length:]
+		err = sgImage.loadAlphaMask(result, alphaBuffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if sgImage.invert {
+		width := result.Bounds().Dx()
+		mirrored := image.NewRGBA(result.Bounds())
+		for y := 0; y < result.Bounds().Dy(); y++ {
+			for x := 0; x < width; x++ {
+				mirrored.SetRGBA(x, y, result.RGBAAt(width-1-x, y))
+			}
+		}
+		result = mirrored
+	}
+
+	if opts.Background != nil {
+		fillBackground(result, *opts.Background)
+	}
+	if opts.FlipVertical {
+		flipRows(result)
+	}
+	return result, nil
+}
 
-	switch sgImage.workRecord.Type {
-	case 0, 1, 10, 12, 13:
-		err = sgImage.loadPlainImage(result, buffer)
-	case 30:
-		err = sgImage.loadIsometricImage(result, buffer)
-	case 256, 257, 276:
-		sgImage.loadSpriteImage(result, buffer)
+// Blend the pixels of img over the background color, making img opaque.
+// The pixels are premultiplied, so only the background is scaled.
+func fillBackground(img *image.RGBA, background color.RGBA) {
+	blend := func(c, bg, alpha uint8) uint8 {
+		return c + uint8((int(bg)*(255-int(alpha))+127)/255)
+	}
+	for i := 0; i < len(img.Pix); i += 4 {
+		alpha := img.Pix[i+3]
+		img.Pix[i] = blend(img.Pix[i], background.R, alpha)
+		img.Pix[i+1] = blend(img.Pix[i+1], background.G, alpha)
+		img.Pix[i+2] = blend(img.Pix[i+2], background.B, alpha)
+		img.Pix[i+3] = 255
+	}
+}
+
+// Reverse the order of the rows of img in place
+func flipRows(img *image.RGBA) {
+	rowLength := img.Bounds().Dx() * 4
+	row := make([]byte, rowLength)
+	for top, bottom := 0, img.Bounds().Dy()-1; top < bottom; top, bottom = top+1, bottom-1 {
+		topRow := img.Pix[top*img.Stride : top*img.Stride+rowLength]
+		bottomRow := img.Pix[bottom*img.Stride : bottom*img.Stride+rowLength]
+		copy(row, topRow)
+		copy(topRow, bottomRow)
+		copy(bottomRow, row)
+	}
+}
+
+// Decodes the image data into pixels in the native 555 format
+func (sgImage *SgImage) decode555(buffer []byte, opts DecodeOptions) (*pixels555, error) {
+	var err error
+	pixels := newPixels555(int(sgImage.workRecord.Width), int(sgImage.workRecord.Height))
+
+	switch sgImage.Type() {
+	case TypePlain, TypePlain1, TypePlain10, TypePlain12, TypePlain13:
+		err = sgImage.loadPlainImage(pixels, buffer)
+	case TypeIsometric:
+		err = sgImage.loadIsometricImage(pixels, buffer, opts)
+	case TypeSprite, TypeSprite257, TypeSprite276:
+		err = sgImage.loadSpriteImage(pixels, buffer)
 	default:
 		return nil, fmt.Errorf("Unknown image type: %d", sgImage.workRecord.Type)
 	}
 	if err != nil {
 		return nil, err
 	}
+	return pixels, nil
+}
 
-	if sgImage.workRecord.AlphaLength > 0 {
-		alphaBuffer := buffer[sgImage.workRecord.Length:]
-		sgImage.loadAlphaMask(result, alphaBuffer)
+// Decodes the image and draws it onto dst with its top left corner at at,
+// blending it over what dst already holds. With the image cache enabled the
+// decoded image comes from the cache, so no image is allocated for images
+// decoded before.
+func (sgImage *SgImage) DrawOnto(dst draw.Image, at image.Point) error {
+	img, err := sgImage.GetImage()
+	if err != nil {
+		return err
+	}
+	draw.Draw(dst, img.Bounds().Add(at), img, img.Bounds().Min, draw.Over)
+	return nil
+}
+
+// Get the part of the image within r, keeping the coordinates of the full
+// image. The image data can't be decoded partially, so the whole image is
+// decoded first and this is no faster than GetImage; it only saves holding
+// on to the full image. Fails if r doesn't overlap the image.
+func (sgImage *SgImage) GetRegion(r image.Rectangle) (*image.RGBA, error) {
+	img, err := sgImage.GetImage()
+	if err != nil {
+		return nil, err
+	}
+	bounds := r.Intersect(img.Bounds())
+	if bounds.Empty() {
+		return nil, fmt.Errorf("Region %v is outside the image bounds %v", r, img.Bounds())
+	}
+
+	// Copy the region, the decoded image may be shared through the cache
+	region := image.NewRGBA(bounds)
+	draw.Draw(region, bounds, img, bounds.Min, draw.Src)
+	return region, nil
+}
+
+// Get the image scaled down to fit within maxDim pixels in both directions,
+// keeping its aspect ratio. Each pixel is the average of the area of the
+// image it covers, weighted by alpha so transparent pixels don't darken the
+// edges. Images that already fit are returned at their own size.
+func (sgImage *SgImage) Thumbnail(maxDim int) (*image.RGBA, error) {
+	if maxDim <= 0 {
+		return nil, fmt.Errorf("Invalid thumbnail size: %d", maxDim)
+	}
+	img, err := sgImage.GetImage()
+	if err != nil {
+		return nil, err
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	scale := min(1, float64(maxDim)/float64(max(width, height)))
+	thumbWidth := max(1, int(float64(width)*scale+0.5))
+	thumbHeight := max(1, int(float64(height)*scale+0.5))
+
+	// The pixels of the image are premultiplied, so plain sums weight the
+	// colors by alpha and the result stays premultiplied
+	columns := areaWeights(width, thumbWidth)
+	rows := areaWeights(height, thumbHeight)
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for ty, rowWeights := range rows {
+		for tx, columnWeights := range columns {
+			var sum [4]float64
+			var total float64
+			for _, row := range rowWeights {
+				for _, column := range columnWeights {
+					weight := row.weight * column.weight
+					offset := img.PixOffset(img.Rect.Min.X+column.index, img.Rect.Min.Y+row.index)
+					for c := 0; c < 4; c++ {
+						sum[c] += weight * float64(img.Pix[offset+c])
+					}
+					total += weight
+				}
+			}
+			offset := thumb.PixOffset(tx, ty)
+			for c := 0; c < 4; c++ {
+				thumb.Pix[offset+c] = uint8(sum[c]/total + 0.5)
+			}
+		}
 	}
+	return thumb, nil
+}
+
+type areaWeight struct {
+	index  int
+	weight float64
+}
+
+// Get, for each of the n pixels a line of size pixels is scaled down to,
+// the source pixels it covers along with how much of each it covers
+func areaWeights(size, n int) [][]areaWeight {
+	step := float64(size) / float64(n)
+	weights := make([][]areaWeight, n)
+	for i := range weights {
+		start, end := float64(i)*step, float64(i+1)*step
+		for j := int(start); j < size && float64(j) < end; j++ {
+			weight := min(end, float64(j+1)) - max(start, float64(j))
+			if weight > 0 {
+				weights[i] = append(weights[i], areaWeight{j, weight})
+			}
+		}
+	}
+	return weights
+}
 
+// Get the decoded pixels in the native 555 format, row by row, along with
+// the width and height of the image. Pixels that aren't drawn hold the
+// transparent key 0xf81f and the alpha mask isn't applied.
+func (sgImage *SgImage) Raw555() ([]uint16, int, int, error) {
+	if sgImage.parent == nil {
+		return nil, 0, 0, ErrNoParent
+	}
+	if err := sgImage.checkRecord(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	buffer, err := sgImage.fillBuffer(DecodeOptions{})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	pixels, err := sgImage.decode555(buffer, DecodeOptions{})
+	if err != nil {
+		return nil, 0, 0, err
+	}
 	if sgImage.invert {
-		mirrored := image.NewRGBA(result.Bounds())
-		for y := 0; y <= result.Bounds().Dy(); y++ {
-			for x := 0; x <= result.Bounds().Dx()/2; x++ {
-				mirrored.Set(x, y, result.At(result.Bounds().Dx()-x, y))
-				mirrored.Set(result.Bounds().Dx()-x, y, result.At(x, y))
+		pixels.mirror()
+	}
+	return pixels.pix, pixels.width, pixels.height, nil
+}
+
+// Get the color key transparency of the image: 0 where a pixel is keyed out
+// or not drawn and 255 everywhere else. Unlike AlphaMask, the stored alpha
+// mask isn't applied, which tells hard color key transparency apart from
+// soft alpha.
+func (sgImage *SgImage) TransparencyBitmap() (*image.Alpha, error) {
+	pixels, width, height, err := sgImage.Raw555()
+	if err != nil {
+		return nil, err
+	}
+
+	mask := image.NewAlpha(image.Rect(0, 0, width, height))
+	for i, c := range pixels {
+		if c != transparent555 {
+			mask.Pix[i] = 255
+		}
+	}
+	return mask, nil
+}
+
+// Get the alpha channel of the decoded image. For images with an alpha mask
+// this is the mask, otherwise pixels are either transparent (0) where the
+// transparent key was used or opaque (255).
+func (sgImage *SgImage) AlphaMask() (*image.Alpha, error) {
+	img, err := sgImage.GetImage()
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	mask := image.NewAlpha(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			mask.SetAlpha(x, y, color.Alpha{img.RGBAAt(x, y).A})
+		}
+	}
+	return mask, nil
+}
+
+// Get the decoded image split into an opaque color image and a grayscale
+// alpha image, for engines that take the alpha channel as a separate
+// texture. The color image holds the stored colors, not premultiplied by the
+// alpha, and pixels that aren't drawn are black in it.
+func (sgImage *SgImage) GetImageAndAlpha() (rgb *image.RGBA, alpha *image.Gray, err error) {
+	rgb, err = sgImage.Decode(DecodeOptions{IgnoreAlpha: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	mask, err := sgImage.AlphaMask()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bounds := rgb.Bounds()
+	alpha = image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// Drawn pixels are already opaque without the alpha mask
+			rgb.Pix[rgb.PixOffset(x, y)+3] = 255
+			alpha.SetGray(x, y, color.Gray{mask.AlphaAt(x, y).A})
+		}
+	}
+	return rgb, alpha, nil
+}
+
+// Get a hash of the decoded pixels, so images stored more than once under
+// different ids can be detected. The hash covers the dimensions and the RGBA
+// values of the image.
+func (sgImage *SgImage) ContentHash() (uint64, error) {
+	img, err := sgImage.GetImage()
+	if err != nil {
+		return 0, err
+	}
+
+	hash := fnv.New64a()
+	bounds := img.Bounds()
+	binary.Write(hash, binary.LittleEndian, [2]int32{int32(bounds.Dx()), int32(bounds.Dy())})
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		offset := img.PixOffset(bounds.Min.X, y)
+		hash.Write(img.Pix[offset : offset+bounds.Dx()*4])
+	}
+	return hash.Sum64(), nil
+}
+
+// Writes the decoded pixels without any encoding, width*height*4 bytes in
+// total. Rows are written from top to bottom with pixels from left to
+// right, each as R, G, B and A bytes, the same layout as the Pix of the
+// image returned by GetImage. The colors are premultiplied by alpha.
+func (sgImage *SgImage) WriteRawRGBA(w io.Writer) error {
+	img, err := sgImage.GetImage()
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		offset := img.PixOffset(bounds.Min.X, y)
+		if _, err := w.Write(img.Pix[offset : offset+bounds.Dx()*4]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the pixels of the image packed as RGB565, row by row, along with the
+// width and height of the image. Red and blue keep their 5 bits, the 5 bit
+// green channel of the source is widened to 6 bits by repeating its top bit
+// (g<<1 | g>>4) so that full intensity stays full intensity. Transparent
+// pixels keep the 0xf81f key, which is magenta in RGB565, and the alpha mask
+// isn't applied.
+func (sgImage *SgImage) GetImage565() ([]uint16, int, int, error) {
+	pixels, width, height, err := sgImage.Raw555()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	result := make([]uint16, len(pixels))
+	for i, c := range pixels {
+		if c == transparent555 {
+			result[i] = transparent555
+			continue
+		}
+		r := (c >> 10) & 0x1f
+		g := (c >> 5) & 0x1f
+		b := c & 0x1f
+		result[i] = r<<11 | (g<<1|g>>4)<<5 | b
+	}
+	return result, width, height, nil
+}
+
+// Get the fraction of pixels that are fully transparent once the image is
+// decoded. An image that is entirely transparent usually means it was not
+// decoded correctly.
+func (sgImage *SgImage) TransparencyRatio() (float64, error) {
+	img, err := sgImage.GetImage()
+	if err != nil {
+		return 0, err
+	}
+
+	bounds := img.Bounds()
+	transparent := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if img.RGBAAt(x, y).A == 0 {
+				transparent++
 			}
 		}
-		return mirrored, nil
 	}
-	return result, nil
+	return float64(transparent) / float64(bounds.Dx()*bounds.Dy()), nil
 }
 
-func (sgImage *SgImage) fillBuffer() ([]byte, error) {
+// Writes the record fields of the image followed by a hex dump of the first
+// bytes of its data, to help with reverse engineering unknown image types
+func (sgImage *SgImage) HexDump(w io.Writer) error {
+	record := sgImage.workRecord
+	var dump strings.Builder
+	fmt.Fprintf(&dump, "id: %d\n", sgImage.imageId)
+	fmt.Fprintf(&dump, "offset: %d\n", record.Offset)
+	fmt.Fprintf(&dump, "length: %d\n", record.Length)
+	fmt.Fprintf(&dump, "uncompressed length: %d\n", record.UncompressedLength)
+	fmt.Fprintf(&dump, "invert offset: %d\n", record.InvertOffset)
+	fmt.Fprintf(&dump, "width: %d\n", record.Width)
+	fmt.Fprintf(&dump, "height: %d\n", record.Height)
+	fmt.Fprintf(&dump, "type: %d\n", record.Type)
+	fmt.Fprintf(&dump, "flags: % x\n", record.Flags)
+	fmt.Fprintf(&dump, "bitmap id: %d\n", record.BitmapId)
+	fmt.Fprintf(&dump, "alpha offset: %d\n", record.AlphaOffset)
+	fmt.Fprintf(&dump, "alpha length: %d\n", record.AlphaLength)
+	if _, err := io.WriteString(w, dump.String()); err != nil {
+		return err
+	}
+
+	buffer, err := sgImage.fillBuffer(DecodeOptions{})
+	if err != nil {
+		return err
+	}
+	if len(buffer) > hexDumpLength {
+		buffer = buffer[:hexDumpLength]
+	}
+	_, err = io.WriteString(w, hex.Dump(buffer))
+	return err
+}
+
+func (sgImage *SgImage) fillBuffer(opts DecodeOptions) ([]byte, error) {
 	if sgImage.parent == nil {
-		return nil, errors.New("Image has no bitmap parent")
+		return nil, ErrNoParent
 	}
-	file, err := sgImage.parent.OpenFile(sgImage.workRecord.Flags[0] != 0)
+	reader, size, err := sgImage.parent.openData(sgImage.IsExternal())
 	if err != nil {
 		return nil, err
 	}
+	return sgImage.readBuffer(reader, size, sgImage.parent.dataName, opts)
+}
 
-	dataLength := sgImage.workRecord.Length + sgImage.workRecord.AlphaLength
+// Decodes the image reading its data through readers rather than the data
+// files shared by the bitmaps, so that several images can be decoded at the
+// same time
+func (sgImage *SgImage) decodeWith(readers *dataReaders, opts DecodeOptions) (*image.RGBA, error) {
+	if sgImage.parent == nil {
+		return nil, ErrNoParent
+	}
+	if err := sgImage.checkRecord(); err != nil {
+		return nil, err
+	}
+
+	name := sgImage.parent.find555File(sgImage.IsExternal())
+	reader, size, err := readers.open(name)
+	if err != nil {
+		return nil, err
+	}
+	buffer, err := sgImage.readBuffer(reader, size, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sgImage.decode(buffer, opts)
+}
+
+// Reads the image data from the named data file of the given size. Missing
+// data at the end of the file is replaced by zeroes if there are only 4
+// bytes missing, or any amount when opts.AllowShortData is set.
+func (sgImage *SgImage) readBuffer(reader io.ReaderAt, size int64, name string, opts DecodeOptions) ([]byte, error) {
+	if size == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrDataFileEmpty, name)
+	}
+
+	// Summed as int64 so that corrupt lengths can't wrap around
+	dataLength := int64(sgImage.workRecord.Length) + int64(sgImage.workRecord.AlphaLength)
 	if dataLength <= 0 {
 		fmt.Printf("Data length: %d\n", dataLength)
 	}
-	buffer := make([]byte, dataLength)
+	// No image can be larger than the file holding it, even when short data
+	// is allowed
+	if dataLength > size+4 {
+		return nil, fmt.Errorf("%w: %d bytes of image data in %s of %d bytes", ErrOffsetOutOfRange, dataLength, name, size)
+	}
 
-	if sgImage.workRecord.Flags[0] != 0 {
-		_, err := file.Seek(int64(sgImage.workRecord.Offset)-1, 0)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		_, err := file.Seek(int64(sgImage.workRecord.Offset), 0)
-		if err != nil {
-			return nil, err
+	offset := int64(sgImage.workRecord.Offset)
+	if sgImage.IsExternal() {
+		// External offsets count from 1, so 0 doesn't point at any data
+		if offset == 0 {
+			return nil, fmt.Errorf("%w: offset 0 of an external image in %s", ErrOffsetOutOfRange, name)
 		}
+		offset--
+	}
+	if dataLength > 0 && offset >= size {
+		return nil, fmt.Errorf("%w: offset %d in %s of %d bytes", ErrOffsetOutOfRange, offset, name, size)
 	}
+	if end := offset + dataLength; end > size+4 && !opts.AllowShortData {
+		return nil, fmt.Errorf("%w: bytes %d to %d in %s of %d bytes", ErrOffsetOutOfRange, offset, end, name, size)
+	}
+	buffer := make([]byte, dataLength)
 
-	dataRead, err := file.Read(buffer)
-	if int(dataLength) != dataRead || err != nil {
-		if dataRead+4 == int(dataLength) {
-			buffer[dataRead] = 0
-			buffer[dataRead+1] = 0
-			buffer[dataRead+2] = 0
-			buffer[dataRead+3] = 0
+	// ReadAt only returns fewer bytes than requested along with an error
+	dataRead, _ := reader.ReadAt(buffer, offset)
+	if int(dataLength) != dataRead {
+		if dataRead+4 == int(dataLength) || opts.AllowShortData {
+			if dataRead+4 != int(dataLength) {
+				opts.warnf("Image %d: only %d of %d bytes available in %s, padding with zeroes", sgImage.imageId, dataRead, dataLength, name)
+			}
+			// ReadAt may use the whole buffer as scratch space
+			clear(buffer[dataRead:])
 		} else {
 			return nil, fmt.Errorf("Unable to read %d bytes from file (read %d bytes)", dataLength, dataRead)
 		}
@@ -238,37 +851,52 @@ func (sgImage *SgImage) fillBuffer() ([]byte, error) {
 	return buffer, nil
 }
 
-func (sgImage *SgImage) loadPlainImage(img *image.RGBA, buffer []byte) error {
-	if int(sgImage.workRecord.Height)*int(sgImage.workRecord.Width)*2 != int(sgImage.workRecord.Length) {
+func (sgImage *SgImage) loadPlainImage(img *pixels555, buffer []byte) error {
+	length := int(sgImage.workRecord.Height) * int(sgImage.workRecord.Width) * 2
+	if length != int(sgImage.workRecord.Length) {
 		return errors.New("Image data length doesn't match image size")
 	}
+	if length > len(buffer) {
+		return errors.New("Image data length exceeds available data")
+	}
 
 	i := 0
 	for y := 0; y < int(sgImage.workRecord.Height); y++ {
 		for x := 0; x < int(sgImage.workRecord.Width); x++ {
-			sgImage.set555Pixel(img, x, y, uint16(buffer[i])|uint16(buffer[i]<<8))
+			img.set(x, y, binary.LittleEndian.Uint16(buffer[i:]))
 			i += 2
 		}
 	}
 	return nil
 }
 
-func (sgImage *SgImage) loadIsometricImage(img *image.RGBA, buffer []byte) error {
-	err := sgImage.writeIsometricBase(img, buffer)
-	if err != nil {
-		return err
+func (sgImage *SgImage) loadIsometricImage(img *pixels555, buffer []byte, opts DecodeOptions) error {
+	if sgImage.workRecord.UncompressedLength > sgImage.workRecord.Length {
+		return fmt.Errorf("Footprint length exceeds image data length: %d vs %d", sgImage.workRecord.UncompressedLength, sgImage.workRecord.Length)
 	}
-	sgImage.writeTransparentImage(img, buffer[sgImage.workRecord.UncompressedLength:], int(sgImage.workRecord.Length-sgImage.workRecord.UncompressedLength))
-	return nil
+	// Images without a footprint consist of the overlay alone
+	if sgImage.workRecord.UncompressedLength > 0 {
+		err := sgImage.writeIsometricBase(img, buffer)
+		if err != nil {
+			if !opts.SkipInvalidBase {
+				return err
+			}
+			opts.warnf("Image %d: skipping isometric base: %v", sgImage.imageId, err)
+		}
+	}
+	return sgImage.writeTransparentImage(img, buffer[sgImage.workRecord.UncompressedLength:], int(sgImage.workRecord.Length-sgImage.workRecord.UncompressedLength))
 }
 
-func (sgImage *SgImage) loadSpriteImage(img *image.RGBA, buffer []byte) {
-	sgImage.writeTransparentImage(img, buffer, int(sgImage.workRecord.Length))
+func (sgImage *SgImage) loadSpriteImage(img *pixels555, buffer []byte) error {
+	return sgImage.writeTransparentImage(img, buffer, int(sgImage.workRecord.Length))
 }
 
-func (sgImage *SgImage) loadAlphaMask(img *image.RGBA, buffer []byte) {
+func (sgImage *SgImage) loadAlphaMask(img *image.RGBA, buffer []byte) error {
 	width := img.Bounds().Dx()
 	length := int(sgImage.workRecord.AlphaLength)
+	if length > len(buffer) {
+		return errors.New("Alpha mask length exceeds image data")
+	}
 	var i, x, y int
 
 	for i < length {
@@ -276,6 +904,9 @@ func (sgImage *SgImage) loadAlphaMask(img *image.RGBA, buffer []byte) {
 		i++
 		if c == 255 {
 			// The next byte is the number of pixels to skip
+			if i >= length {
+				return errors.New("Alpha mask data truncated")
+			}
 			x += int(buffer[i])
 			i++
 			for x >= width {
@@ -284,6 +915,9 @@ func (sgImage *SgImage) loadAlphaMask(img *image.RGBA, buffer []byte) {
 			}
 		} else {
 			// 'c' is the number of image data bytes
+			if i+2*c-1 > length {
+				return errors.New("Alpha mask data truncated")
+			}
 			for j := 0; j < c; j++ {
 				sgImage.setAlphaPixel(img, x, y, buffer[i])
 				x++
@@ -295,46 +929,36 @@ func (sgImage *SgImage) loadAlphaMask(img *image.RGBA, buffer []byte) {
 			}
 		}
 	}
+	return nil
 }
 
-func (sgImage *SgImage) writeIsometricBase(img *image.RGBA, buffer []byte) error {
+func (sgImage *SgImage) writeIsometricBase(img *pixels555, buffer []byte) error {
 	width := img.Bounds().Dx()
-	height := (width + 2) / 2 /* 58 -> 30, 118 -> 60, etc */
-	heightOffset := img.Bounds().Dy() - height
-	var size int
-	size = int(sgImage.workRecord.Flags[3])
-	yOffset := heightOffset
-	var xOffset, tileBytes, tileHeight, tileWidth int
 
-	if size == 0 {
-		/* Derive the tile size from the height (more regular than width)
-		 * Note that this causes a problem with 4x4 regular vs 3x3 large:
-		 * 4 * 30 = 120; 3 * 40 = 120 -- give precedence to regular */
-		if height%ISOMETRIC_TILE_HEIGHT == 0 {
-			size = height / ISOMETRIC_TILE_HEIGHT
-		} else if height%ISOMETRIC_LARGE_TILE_HEIGHT == 0 {
-			size = height / ISOMETRIC_LARGE_TILE_HEIGHT
-		}
+	/* The footprint size in Flags[3] decides between regular and large
+	 * tiles, as only one of them spans the width of the image with that
+	 * many tiles. Without it the size is derived from the width, which is
+	 * ambiguous whenever width + 2 is a multiple of 240: a 4x4 regular and
+	 * a 3x3 large footprint have the same width, height and data length.
+	 * Regular tiles take precedence then, so large footprints of 3x3 or 6x6
+	 * tiles only decode correctly when Flags[3] is set. Tile sizes added
+	 * with RegisterTileProfile are tried after both. */
+	profile, size, err := findTileProfile(width, int(sgImage.workRecord.Flags[3]))
+	if err != nil {
+		return err
 	}
+	tileBytes, tileHeight, tileWidth := profile.bytes, profile.height, profile.width
+	yOffset := img.Bounds().Dy() - size*tileHeight
+	var xOffset int
 
-	// Determine whether we should use the regular or large (emperor) tiles
-	if ISOMETRIC_TILE_HEIGHT*size == height {
-		// Regular tile
-		tileBytes = ISOMETRIC_TILE_BYTES
-		tileHeight = ISOMETRIC_TILE_HEIGHT
-		tileWidth = ISOMETRIC_TILE_WIDTH
-	} else if ISOMETRIC_LARGE_TILE_HEIGHT*size == height {
-		// Large (emperor) tile
-		tileBytes = ISOMETRIC_LARGE_TILE_BYTES
-		tileHeight = ISOMETRIC_LARGE_TILE_HEIGHT
-		tileWidth = ISOMETRIC_LARGE_TILE_WIDTH
-	} else {
-		return fmt.Errorf("Unknown tile size: %d (height %d, width %d, size %d)", 2*height/size, height, width, size)
+	// Check if the footprint length matches the number of tiles
+	if size*size*tileBytes != int(sgImage.workRecord.UncompressedLength) {
+		return fmt.Errorf("Data length doesn't match footprint size: %d vs %d (%d) %d", size*size*tileBytes, sgImage.workRecord.UncompressedLength, sgImage.workRecord.Length, sgImage.workRecord.InvertOffset)
 	}
 
-	// Check if buffer length is enough: (width + 2) * height / 2 * 2bpp
-	if (width+2)*height != int(sgImage.workRecord.UncompressedLength) {
-		return fmt.Errorf("Data length doesn't match footprint size: %d vs %d (%d) %d", (width+2)*height, sgImage.workRecord.UncompressedLength, sgImage.workRecord.Length, sgImage.workRecord.InvertOffset)
+	// Every tile of the footprint must be fully present in the buffer
+	if size*size*tileBytes > len(buffer) {
+		return fmt.Errorf("Footprint needs %d bytes but only %d are available", size*size*tileBytes, len(buffer))
 	}
 
 	i := 0
@@ -347,7 +971,7 @@ func (sgImage *SgImage) writeIsometricBase(img *image.RGBA, buffer []byte) error
 			xOffset = y - size + 1
 			xRange = 2*size - y - 1
 		}
-		xOffset *= tileHeight
+		xOffset *= (tileWidth + 2) / 2
 		for x := 0; x < xRange; x++ {
 			sgImage.writeIsometricTile(img, buffer[i*tileBytes:], xOffset, yOffset, tileWidth, tileHeight)
 			xOffset += tileWidth + 2
@@ -358,14 +982,14 @@ func (sgImage *SgImage) writeIsometricBase(img *image.RGBA, buffer []byte) error
 	return nil
 }
 
-func (sgImage *SgImage) writeIsometricTile(img *image.RGBA, buffer []byte, xOffset, yOffset, tileWidth, tileHeight int) {
+func (sgImage *SgImage) writeIsometricTile(img *pixels555, buffer []byte, xOffset, yOffset, tileWidth, tileHeight int) {
 	halfHeight := tileHeight / 2
 	i := 0
 	for y := 0; y < halfHeight; y++ {
 		start := tileHeight - 2*(y+1)
 		end := tileWidth - start
 		for x := start; x < end; x++ {
-			sgImage.set555Pixel(img, xOffset+x, yOffset+y, uint16(buffer[i+1]<<8)|uint16(buffer[i]))
+			img.set(xOffset+x, yOffset+y, binary.LittleEndian.Uint16(buffer[i:]))
 			i += 2
 		}
 	}
@@ -373,14 +997,17 @@ func (sgImage *SgImage) writeIsometricTile(img *image.RGBA, buffer []byte, xOffs
 		start := 2*y - tileHeight
 		end := tileWidth - start
 		for x := start; x < end; x++ {
-			sgImage.set555Pixel(img, xOffset+x, yOffset+y, uint16(buffer[i+1]<<8)|uint16(buffer[i]))
+			img.set(xOffset+x, yOffset+y, binary.LittleEndian.Uint16(buffer[i:]))
 			i += 2
 		}
 	}
 }
 
-func (sgImage *SgImage) writeTransparentImage(img *image.RGBA, buffer []byte, length int) {
+func (sgImage *SgImage) writeTransparentImage(img *pixels555, buffer []byte, length int) error {
 	width := img.Bounds().Dx()
+	if length > len(buffer) {
+		return errors.New("Image data length exceeds available data")
+	}
 
 	var i, x, y int
 
@@ -389,6 +1016,9 @@ func (sgImage *SgImage) writeTransparentImage(img *image.RGBA, buffer []byte, le
 		i++
 		if c == 255 {
 			// The next byte is the number of pixels to skip
+			if i >= length {
+				return errors.New("Image data truncated")
+			}
 			x += int(buffer[i])
 			i++
 			for x >= width {
@@ -397,8 +1027,11 @@ func (sgImage *SgImage) writeTransparentImage(img *image.RGBA, buffer []byte, le
 			}
 		} else {
 			// 'c' is the number of image data bytes
+			if i+2*c > length {
+				return errors.New("Image data truncated")
+			}
 			for j := 0; j < c; j++ {
-				sgImage.set555Pixel(img, x, y, uint16(buffer[i+1]<<8)|uint16(buffer[i]))
+				img.set(x, y, binary.LittleEndian.Uint16(buffer[i:]))
 				x++
 				if x >= width {
 					y++
@@ -408,31 +1041,79 @@ func (sgImage *SgImage) writeTransparentImage(img *image.RGBA, buffer []byte, le
 			}
 		}
 	}
+	return nil
 }
 
+// Sets the pixel to the 555 color c, laid out as 0RRRRRGGGGGBBBBB with red
+// in the high bits. The key 0xf81f has the unused top bit set, so it can't
+// be a color and leaves the pixel transparent.
 func (sgImage *SgImage) set555Pixel(img *image.RGBA, x, y int, c uint16) {
-	if c == 0xf81f {
+	if c == transparent555 {
 		return
 	}
 
-	var rgb uint32
-	rgb = 0xff000000
+	// Each 5 bit channel is expanded to 8 bits by repeating its top bits in
+	// the low bits, so that 0x1f maps to 0xff and 0 maps to 0
+	r := uint8(c>>10) & 0x1f
+	g := uint8(c>>5) & 0x1f
+	b := uint8(c) & 0x1f
 
-	// Red: bits 11-15, should go to bits 17-24
-	rgb |= uint32((c&0x7c00)<<9) | uint32((c&0x7000)<<4)
+	img.SetRGBA(x, y, color.RGBA{r<<3 | r>>2, g<<3 | g>>2, b<<3 | b>>2, 255})
+}
 
-	// Green: bits 6-10, should go to bits 9-16
-	rgb |= uint32((c&0x3e0)<<6) | uint32(c&0x300)
+func (sgImage *SgImage) setAlphaPixel(img *image.RGBA, x, y int, c2 uint8) {
+	alpha := ((c2 & 0x1f) << 3) | ((c2 & 0x1c) >> 2)
+	// image.RGBA holds premultiplied colors, so the opaque color decoded
+	// from the image data is scaled by the alpha of the mask
+	premultiply := func(v uint8) uint8 {
+		return uint8((int(v)*int(alpha) + 127) / 255)
+	}
+	c := img.RGBAAt(x, y)
+	img.SetRGBA(x, y, color.RGBA{premultiply(c.R), premultiply(c.G), premultiply(c.B), alpha})
+}
 
-	// Blue: bits 1-5, should go to bits 1-8
-	rgb |= uint32((c&0x1f)<<3) | uint32((c&0x1c)>>2)
+const (
+	transparent555 uint16 = 0xf81f
+)
 
-	img.Set(x, y, color.RGBA{uint8(rgb & 0x000000ff), uint8((rgb & 0x0000ff00) >> 8), uint8((rgb & 0x00ff0000) >> 16), 255})
+// pixels555 holds decoded pixels in the native 555 format. Pixels that
+// aren't drawn by the decoders keep the transparent key.
+type pixels555 struct {
+	pix    []uint16
+	width  int
+	height int
 }
 
-func (sgImage *SgImage) setAlphaPixel(img *image.RGBA, x, y int, c2 uint8) {
-	alpha := ((c2 & 0x1f) << 3) | ((c2 & 0x1c) >> 2)
-	c := img.At(x, y)
-	r, g, b, _ := c.RGBA()
-	img.Set(x, y, color.RGBA{uint8(r), uint8(g), uint8(b), alpha})
+func newPixels555(width, height int) *pixels555 {
+	pix := make([]uint16, width*height)
+	for i := range pix {
+		pix[i] = transparent555
+	}
+	return &pixels555{pix: pix, width: width, height: height}
+}
+
+func (pixels *pixels555) Bounds() image.Rectangle {
+	return image.Rect(0, 0, pixels.width, pixels.height)
+}
+
+func (pixels *pixels555) at(x, y int) uint16 {
+	return pixels.pix[y*pixels.width+x]
+}
+
+// Pixels outside the image are ignored, as image.RGBA.Set does
+func (pixels *pixels555) set(x, y int, c uint16) {
+	if x < 0 || y < 0 || x >= pixels.width || y >= pixels.height {
+		return
+	}
+	pixels.pix[y*pixels.width+x] = c
+}
+
+// Flip the pixels horizontally
+func (pixels *pixels555) mirror() {
+	for y := 0; y < pixels.height; y++ {
+		row := pixels.pix[y*pixels.width : (y+1)*pixels.width]
+		for i, j := 0, len(row)-1; i < j; i, j = i+1, j-1 {
+			row[i], row[j] = row[j], row[i]
+		}
+	}
 }
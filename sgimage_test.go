@@ -0,0 +1,763 @@
+package sgreader
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"log"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Feeds arbitrary image records and data to the decoders, which must fail
+// with an error rather than panic
+func FuzzDecodeImage(f *testing.F) {
+	sprite := append([]byte{255, 1, 2}, plainData(0x1234, 0x4321)...)
+	f.Add(uint32(0), uint32(8), uint32(0), uint32(0), int16(2), int16(2), uint16(TypePlain), uint8(0), false, plainData(0x7c00, 0x03e0, 0x001f, 0x7fff))
+	f.Add(uint32(0), uint32(len(sprite)), uint32(0), uint32(0), int16(3), int16(1), uint16(TypeSprite), uint8(0), false, sprite)
+	f.Add(uint32(1), uint32(len(sprite)), uint32(0), uint32(0), int16(3), int16(1), uint16(TypeSprite), uint8(0), true, sprite)
+	f.Add(uint32(0), uint32(len(sprite)), uint32(0), uint32(5), int16(3), int16(1), uint16(TypeSprite), uint8(0), false, append(sprite, 2, 0x10, 0, 0x1f, 0))
+	f.Add(uint32(0), uint32(ISOMETRIC_TILE_BYTES), uint32(ISOMETRIC_TILE_BYTES), uint32(0), int16(ISOMETRIC_TILE_WIDTH), int16(ISOMETRIC_TILE_HEIGHT), uint16(TypeIsometric), uint8(1), false, make([]byte, ISOMETRIC_TILE_BYTES))
+	f.Add(uint32(0), uint32(len(sprite)), uint32(0), uint32(0), int16(58), int16(40), uint16(TypeIsometric), uint8(0), false, sprite)
+
+	f.Fuzz(func(t *testing.T, offset, length, uncompressedLength, alphaLength uint32, width, height int16, imageType uint16, footprint uint8, external bool, data []byte) {
+		// Huge images are valid, but only cost memory
+		if int(width)*int(height) > 1<<16 {
+			t.Skip()
+		}
+		record := SgImageRecord{
+			Offset:             offset,
+			Length:             length,
+			UncompressedLength: uncompressedLength,
+			AlphaLength:        alphaLength,
+			Width:              width,
+			Height:             height,
+			Type:               imageType,
+		}
+		record.Flags[3] = footprint
+		if external {
+			record.Flags[0] = 1
+		}
+
+		sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("test.bmp", 1, 1)}, []SgImageRecord{record})
+		sgFile, err := ReadMemory(sg, map[string][]byte{"test.555": data}, "test.sg3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sgImage := sgFile.GetBitmap(0).Image(0)
+		sgImage.GetImage()
+		sgImage.Decode(DecodeOptions{AllowShortData: true, SkipInvalidBase: true})
+		sgImage.Raw555()
+		DecodeAt(bytes.NewReader(data), int64(offset), record)
+	})
+}
+
+func TestReadBufferRejectsWrappingLength(t *testing.T) {
+	images := []SgImageRecord{{Length: 0xfffffff0, AlphaLength: 0x20, Width: 2, Height: 2}}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("test.bmp", 1, 1)}, images, make([]byte, 64))
+	if _, err := sgFile.GetBitmap(0).GetImage(0); err == nil {
+		t.Error("Decoded an image whose data is larger than the data file")
+	}
+}
+
+func TestDecodeAt(t *testing.T) {
+	data := append(make([]byte, 10), plainData(0x7c00, 0x001f)...)
+	img, err := DecodeAt(bytes.NewReader(data), 10, SgImageRecord{Length: 4, Width: 2, Height: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{255, 0, 0, 255, 0, 0, 255, 255}
+	if !bytes.Equal(img.Pix, want) {
+		t.Errorf("Got pixels %v, want %v", img.Pix, want)
+	}
+}
+
+func TestDecodeAtRejectsBadLengths(t *testing.T) {
+	data := make([]byte, 64)
+	records := []SgImageRecord{
+		{Length: 8, AlphaLength: 0xfffffffc, Width: 2, Height: 2},
+		{Length: 0xfffffff0, AlphaLength: 0x20, Width: 2, Height: 2},
+		{Length: 80, Width: 8, Height: 5},
+	}
+	for _, record := range records {
+		if _, err := DecodeAt(bytes.NewReader(data), 0, record); err == nil {
+			t.Errorf("Decoded %d+%d bytes from a file of %d bytes", record.Length, record.AlphaLength, len(data))
+		}
+	}
+}
+
+func TestAlphaMaskPremultipliesColors(t *testing.T) {
+	sgImage := alphaFixture(t).GetBitmap(0).Image(0)
+	want := []byte{
+		0x84, 0, 0, 0x84, 255, 255, 255, 255,
+		0, 0, 0, 0, 0, 0, 0x84, 0x84,
+	}
+	img, err := sgImage.GetImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.Pix, want) {
+		t.Errorf("Got pixels %v, want %v", img.Pix, want)
+	}
+	// Straight alpha gives back the stored color
+	if got := color.NRGBAModel.Convert(img.At(0, 0)); got != (color.NRGBA{255, 0, 0, 0x84}) {
+		t.Errorf("Got straight color %v, want opaque red at alpha 0x84", got)
+	}
+}
+
+func TestDrawOntoBlendsOverlappingImages(t *testing.T) {
+	canvas := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	if err := sampleFixture(t).GetBitmap(0).Image(0).DrawOnto(canvas, image.Pt(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := alphaFixture(t).GetBitmap(0).Image(0).DrawOnto(canvas, image.Pt(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// The translucent red pixel lands on the green one and the transparent
+	// pixel leaves the white one alone
+	want := []byte{
+		255, 0, 0, 255, 0x84, 0x7b, 0, 255, 255, 255, 255, 255,
+		0, 0, 255, 255, 255, 255, 255, 255, 0, 0, 0x84, 0x84,
+	}
+	if !bytes.Equal(canvas.Pix, want) {
+		t.Errorf("Got pixels %v, want %v", canvas.Pix, want)
+	}
+}
+
+func TestDecodeBackground(t *testing.T) {
+	img, err := alphaFixture(t).GetBitmap(0).Image(0).Decode(DecodeOptions{Background: &color.RGBA{0, 255, 0, 255}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x84, 0x7b, 0, 255, 255, 255, 255, 255,
+		0, 255, 0, 255, 0, 0x7b, 0x84, 255,
+	}
+	if !bytes.Equal(img.Pix, want) {
+		t.Errorf("Got pixels %v, want %v", img.Pix, want)
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	// A white 4x4 sprite whose top left quarter is transparent
+	data := []byte{255, 2, 2}
+	data = append(data, plainData(0x7fff, 0x7fff)...)
+	data = append(data, 255, 2, 2)
+	data = append(data, plainData(0x7fff, 0x7fff)...)
+	data = append(data, 8)
+	data = append(data, plainData(0x7fff, 0x7fff, 0x7fff, 0x7fff, 0x7fff, 0x7fff, 0x7fff, 0x7fff)...)
+	images := []SgImageRecord{{Length: uint32(len(data)), Width: 4, Height: 4, Type: uint16(TypeSprite)}}
+	sgImage := loadFixture(t, []SgBitmapRecord{bitmapRecord("test.bmp", 1, 1)}, images, data).GetBitmap(0).Image(0)
+
+	thumb, err := sgImage.Thumbnail(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := thumb.Bounds().Size(); size != image.Pt(3, 3) {
+		t.Errorf("Got a %v thumbnail, want 3x3", size)
+	}
+
+	thumb, err = sgImage.Thumbnail(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0, 0, 0, 0, 255, 255, 255, 255,
+		255, 255, 255, 255, 255, 255, 255, 255,
+	}
+	if !bytes.Equal(thumb.Pix, want) {
+		t.Errorf("Got pixels %v, want %v", thumb.Pix, want)
+	}
+}
+
+func TestThumbnailKeepsColorsPremultiplied(t *testing.T) {
+	thumb, err := alphaFixture(t).GetBitmap(0).Image(0).Thumbnail(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{97, 64, 97, 130}; !bytes.Equal(thumb.Pix, want) {
+		t.Errorf("Got pixels %v, want %v", thumb.Pix, want)
+	}
+}
+
+func TestSet555Pixel(t *testing.T) {
+	tests := []struct {
+		c    uint16
+		want color.RGBA
+	}{
+		{0x7c00, color.RGBA{255, 0, 0, 255}},
+		{0x03e0, color.RGBA{0, 255, 0, 255}},
+		{0x001f, color.RGBA{0, 0, 255, 255}},
+		{0x4210, color.RGBA{0x84, 0x84, 0x84, 255}},
+		{0xf81f, color.RGBA{}},
+	}
+	for _, test := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		(&SgImage{}).set555Pixel(img, 0, 0, test.c)
+		if got := img.RGBAAt(0, 0); got != test.want {
+			t.Errorf("%#04x: got %v, want %v", test.c, got, test.want)
+		}
+	}
+}
+
+func TestExternalImageAtOffsetZero(t *testing.T) {
+	image := SgImageRecord{Offset: 0, Length: 2, Width: 1, Height: 1}
+	image.Flags[0] = 1
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("ext.bmp", 1, 1)}, []SgImageRecord{image})
+	sgFile, err := ReadMemory(sg, map[string][]byte{"ext.555": plainData(0x7fff, 0x7fff)}, "test.sg3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []DecodeOptions{{}, {AllowShortData: true}} {
+		if _, err := sgFile.GetBitmap(0).Image(0).Decode(opts); !errors.Is(err, ErrOffsetOutOfRange) {
+			t.Errorf("Got error %v with %+v, want ErrOffsetOutOfRange", err, opts)
+		}
+	}
+}
+
+func TestTransparencyRatio(t *testing.T) {
+	// A 4x4 sprite with a single pixel drawn
+	data := append([]byte{255, 5, 1}, plainData(0x7fff)...)
+	images := []SgImageRecord{
+		{Length: 8, Width: 2, Height: 2},
+		{Offset: 8, Length: uint32(len(data)), Width: 4, Height: 4, Type: uint16(TypeSprite)},
+	}
+	bitmap := loadFixture(t, []SgBitmapRecord{bitmapRecord("test.bmp", 1, 2)}, images, append(plainData(1, 2, 3, 4), data...)).GetBitmap(0)
+
+	for i, want := range []float64{0, 15.0 / 16} {
+		ratio, err := bitmap.Image(i).TransparencyRatio()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ratio != want {
+			t.Errorf("Image %d: got ratio %v, want %v", i, ratio, want)
+		}
+	}
+}
+
+func TestDecodeIgnoreAlpha(t *testing.T) {
+	img, err := alphaFixture(t).GetBitmap(0).Image(0).Decode(DecodeOptions{IgnoreAlpha: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		255, 0, 0, 255, 255, 255, 255, 255,
+		0, 0, 0, 0, 0, 0, 255, 255,
+	}
+	if !bytes.Equal(img.Pix, want) {
+		t.Errorf("Got pixels %v, want %v", img.Pix, want)
+	}
+}
+
+func TestHexDump(t *testing.T) {
+	var buf bytes.Buffer
+	if err := sampleFixture(t).GetBitmap(0).Image(0).HexDump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+	for _, line := range []string{"id: 1\n", "offset: 0\n", "length: 8\n", "width: 2\n", "height: 2\n", "type: 0\n"} {
+		if !strings.Contains(dump, line) {
+			t.Errorf("Dump lacks the line %q:\n%s", line, dump)
+		}
+	}
+	if want := hex.Dump(plainData(0x7c00, 0x03e0, 0x001f, 0x7fff)); !strings.HasSuffix(dump, want) {
+		t.Errorf("Dump doesn't end with the image data:\n%s", dump)
+	}
+}
+
+func TestRaw555(t *testing.T) {
+	bitmap := sampleFixture(t).GetBitmap(0)
+	tests := []struct {
+		index         int
+		width, height int
+		want          []uint16
+	}{
+		{0, 2, 2, []uint16{0x7c00, 0x03e0, 0x001f, 0x7fff}},
+		{1, 3, 2, []uint16{0xf81f, 0x1234, 0x4321, 0xf81f, 0x7fff, 0xf81f}},
+	}
+	for _, test := range tests {
+		sgImage := bitmap.Image(test.index)
+		pixels, width, height, err := sgImage.Raw555()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if width != test.width || height != test.height || !slices.Equal(pixels, test.want) {
+			t.Errorf("Image %d: got %dx%d %#04x, want %dx%d %#04x", test.index, width, height, pixels, test.width, test.height, test.want)
+			continue
+		}
+
+		// Expanding the raw pixels gives the decoded image
+		expanded := image.NewRGBA(image.Rect(0, 0, width, height))
+		for i, c := range pixels {
+			sgImage.set555Pixel(expanded, i%width, i/width, c)
+		}
+		if decoded := mustDecode(t, sgImage); !bytes.Equal(expanded.Pix, decoded) {
+			t.Errorf("Image %d: expanded %v, decoded %v", test.index, expanded.Pix, decoded)
+		}
+	}
+}
+
+func TestImageCache(t *testing.T) {
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}}
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, images)
+	data := &rangeReaderAt{data: plainData(0x7c00)}
+	sgFile, err := ReadReaderAt(bytes.NewReader(sg), int64(len(sg)), readerAtSource{"test.555": data}, "test.sg3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sgFile.EnableCache(1)
+
+	first := mustDecode(t, sgFile.GetBitmap(0).Image(0))
+	reads := len(data.ranges)
+	second := mustDecode(t, sgFile.GetBitmap(0).Image(0))
+	if len(data.ranges) != reads {
+		t.Errorf("Decoding again read the data file %d more times", len(data.ranges)-reads)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("Got cached pixels %v, want %v", second, first)
+	}
+
+	// Reloading the file drops the cached images
+	if err := sgFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	mustDecode(t, sgFile.GetBitmap(0).Image(0))
+	if len(data.ranges) == reads {
+		t.Error("Decoding after a reload didn't read the data file")
+	}
+}
+
+func TestEmptyDataFile(t *testing.T) {
+	sg := buildSG(t, versionSG3, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, []SgImageRecord{{Length: 2, Width: 1, Height: 1}})
+	tests := []struct {
+		data map[string][]byte
+		want error
+	}{
+		{map[string][]byte{"test.555": {}}, ErrDataFileEmpty},
+		{nil, ErrDataNotFound},
+	}
+	for _, test := range tests {
+		sgFile, err := ReadMemory(sg, test.data, "test.sg3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sgFile.GetBitmap(0).GetImage(0); !errors.Is(err, test.want) {
+			t.Errorf("Got error %v, want %v", err, test.want)
+		}
+	}
+}
+
+func TestAlphaMask(t *testing.T) {
+	tests := []struct {
+		sgImage *SgImage
+		want    []byte
+	}{
+		{sampleFixture(t).GetBitmap(0).Image(1), []byte{0, 255, 255, 0, 255, 0}},
+		{alphaFixture(t).GetBitmap(0).Image(0), []byte{0x84, 255, 0, 0x84}},
+	}
+	for _, test := range tests {
+		mask, err := test.sgImage.AlphaMask()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(mask.Pix, test.want) {
+			t.Errorf("Got mask %v, want %v", mask.Pix, test.want)
+		}
+	}
+}
+
+func TestGetImageAndAlpha(t *testing.T) {
+	rgb, alpha, err := alphaFixture(t).GetBitmap(0).Image(0).GetImageAndAlpha()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The colors keep their full intensity, the transparent pixel is black
+	want := []byte{255, 0, 0, 255, 255, 255, 255, 255, 0, 0, 0, 255, 0, 0, 255, 255}
+	if !bytes.Equal(rgb.Pix, want) {
+		t.Errorf("Got colors %v, want %v", rgb.Pix, want)
+	}
+	if want := []byte{0x84, 255, 0, 0x84}; !bytes.Equal(alpha.Pix, want) {
+		t.Errorf("Got alpha %v, want %v", alpha.Pix, want)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	images := []SgImageRecord{
+		{Length: 4, Width: 2, Height: 1},
+		{Offset: 4, Length: 4, Width: 2, Height: 1},
+		{Offset: 8, Length: 4, Width: 2, Height: 1},
+		{Length: 4, Width: 1, Height: 2},
+	}
+	data := plainData(0x7c00, 0x001f, 0x7c00, 0x001f, 0x001f, 0x7c00)
+	bitmap := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 4)}, images, data).GetBitmap(0)
+
+	hashes := make([]uint64, len(images))
+	for i := range hashes {
+		var err error
+		if hashes[i], err = bitmap.Image(i).ContentHash(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hashes[0] != hashes[1] {
+		t.Error("Identical images have different hashes")
+	}
+	if hashes[0] == hashes[2] {
+		t.Error("Images with swapped pixels share a hash")
+	}
+	if hashes[0] == hashes[3] {
+		t.Error("Images of different sizes with the same pixels share a hash")
+	}
+}
+
+func TestWriteRawRGBA(t *testing.T) {
+	var buf bytes.Buffer
+	if err := sampleFixture(t).GetBitmap(0).Image(1).WriteRawRGBA(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 3*2*4 {
+		t.Errorf("Got %d bytes, want %d", buf.Len(), 3*2*4)
+	}
+	// The first pixel is transparent and the second 0x1234
+	if want := []byte{0, 0, 0, 0, 0x21, 0x8c, 0xa5, 255}; !bytes.HasPrefix(buf.Bytes(), want) {
+		t.Errorf("Got %v, want it to start with %v", buf.Bytes(), want)
+	}
+}
+
+func TestGetImage565(t *testing.T) {
+	images := []SgImageRecord{{Length: 8, Width: 4, Height: 1}}
+	data := plainData(0x7fff, 0x03e0, 0x0210, 0x7c0f)
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, images, data)
+
+	pixels, width, height, err := sgFile.GetBitmap(0).Image(0).GetImage565()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Full green stays full green, half green gains its top bit as the low
+	// bit and red and blue are unchanged
+	want := []uint16{0xffff, 0x07e0, 0x0430, 0xf80f}
+	if width != 4 || height != 1 || !slices.Equal(pixels, want) {
+		t.Errorf("Got %dx%d %#04x, want 4x1 %#04x", width, height, pixels, want)
+	}
+
+	pixels, _, _, err = sampleFixture(t).GetBitmap(0).Image(1).GetImage565()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pixels[0] != 0xf81f {
+		t.Errorf("Got transparent pixel %#04x, want the key 0xf81f", pixels[0])
+	}
+}
+
+func TestAllowShortData(t *testing.T) {
+	var pixels []uint16
+	for i := 0; i < 48; i++ {
+		pixels = append(pixels, 0x7fff)
+	}
+	images := []SgImageRecord{{Length: 64, Width: 8, Height: 4}, {Offset: 64, Length: 32, Width: 4, Height: 4}}
+	data := plainData(pixels...)
+	// The last image is missing its last 20 bytes
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 2)}, images, data[:len(data)-20])
+	sgImage := sgFile.GetBitmap(0).Image(1)
+
+	if _, err := sgImage.GetImage(); err == nil {
+		t.Error("Decoded a truncated image without AllowShortData")
+	}
+	var warnings strings.Builder
+	img, err := sgImage.Decode(DecodeOptions{AllowShortData: true, Logger: log.New(&warnings, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Image 2: only 12 of 32 bytes available in test.555, padding with zeroes\n"; warnings.String() != want {
+		t.Errorf("Got warnings %q, want %q", warnings.String(), want)
+	}
+	// The 6 pixels that are there are white and the 10 missing ones black
+	for i := 0; i < 16; i++ {
+		want := color.RGBA{255, 255, 255, 255}
+		if i >= 6 {
+			want = color.RGBA{0, 0, 0, 255}
+		}
+		if got := img.RGBAAt(i%4, i/4); got != want {
+			t.Errorf("Got pixel %d %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestSkipInvalidBase(t *testing.T) {
+	// A footprint of 4 bytes matches no tile size for a 10 pixel wide image,
+	// the overlay draws a single white pixel
+	data := append([]byte{0, 0, 0, 0, 1}, plainData(0x7fff)...)
+	images := []SgImageRecord{{Length: uint32(len(data)), UncompressedLength: 4, Width: 10, Height: 2, Type: uint16(TypeIsometric)}}
+	sgImage := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, images, data).GetBitmap(0).Image(0)
+
+	if _, err := sgImage.GetImage(); err == nil {
+		t.Error("Decoded an isometric image with an invalid base")
+	}
+	var warnings strings.Builder
+	img, err := sgImage.Decode(DecodeOptions{SkipInvalidBase: true, Logger: log.New(&warnings, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(warnings.String(), "Image 1: skipping isometric base: ") {
+		t.Errorf("Got warnings %q, want the skipped base reported", warnings.String())
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 10; x++ {
+			want := color.RGBA{}
+			if x == 0 && y == 0 {
+				want = color.RGBA{255, 255, 255, 255}
+			}
+			if got := img.RGBAAt(x, y); got != want {
+				t.Errorf("Got pixel %d,%d %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestFlipVertical(t *testing.T) {
+	images := []SgImageRecord{
+		{Length: 12, Width: 3, Height: 2},
+		// Mirrored horizontally as well
+		{Length: 12, Width: 3, Height: 2, InvertOffset: 1},
+	}
+	data := plainData(0x7c00, 0x03e0, 0x001f, 0x7fff, 0x4210, 0x0000)
+	bitmap := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 2)}, images, data).GetBitmap(0)
+
+	for i := range images {
+		sgImage := bitmap.Image(i)
+		img, err := sgImage.GetImage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		flipped, err := sgImage.Decode(DecodeOptions{FlipVertical: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []byte
+		for y := img.Rect.Dy() - 1; y >= 0; y-- {
+			want = append(want, img.Pix[y*img.Stride:(y+1)*img.Stride]...)
+		}
+		if !bytes.Equal(flipped.Pix, want) {
+			t.Errorf("Image %d: got %v, want %v", i, flipped.Pix, want)
+		}
+	}
+	// The mirrored image starts with the last pixel of the first row
+	if pix := mustDecode(t, bitmap.Image(1)); !bytes.Equal(pix[:4], []byte{0, 0, 255, 255}) {
+		t.Errorf("Got first pixel %v of the mirrored image, want blue", pix[:4])
+	}
+}
+
+func TestGetRegion(t *testing.T) {
+	sgImage := sampleFixture(t).GetBitmap(0).Image(1)
+	img, err := sgImage.GetImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := image.Rect(1, 0, 3, 2)
+	region, err := sgImage.GetRegion(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region.Bounds() != r {
+		t.Fatalf("Got bounds %v, want %v", region.Bounds(), r)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if got, want := region.RGBAAt(x, y), img.RGBAAt(x, y); got != want {
+				t.Errorf("Got pixel %d,%d %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	if _, err := sgImage.GetRegion(image.Rect(5, 5, 6, 6)); err == nil {
+		t.Error("Got a region outside the image")
+	}
+}
+
+func TestRawData(t *testing.T) {
+	sgFile := alphaFixture(t)
+	sgImage := sgFile.GetBitmap(0).Image(0)
+	data, err := sgImage.RawData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := sgImage.workRecord
+	if len(data) != int(record.Length+record.AlphaLength) {
+		t.Errorf("Got %d bytes, want %d", len(data), record.Length+record.AlphaLength)
+	}
+	if want := append([]byte{2}, plainData(0x7c00, 0x7fff)...); !bytes.HasPrefix(data, want) {
+		t.Errorf("Got %v, want it to start with %v", data, want)
+	}
+}
+
+func TestDecodeDebugTransparent(t *testing.T) {
+	magenta := color.RGBA{255, 0, 255, 255}
+	images := []SgImageRecord{{Length: 4, Width: 2, Height: 1}}
+	plain := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, images, plainData(0xf81f, 0x7c00)).GetBitmap(0).Image(0)
+	sprite := sampleFixture(t).GetBitmap(0).Image(1)
+
+	tests := []struct {
+		sgImage *SgImage
+		want    []byte
+	}{
+		{plain, []byte{255, 0, 255, 255, 255, 0, 0, 255}},
+		{sprite, []byte{
+			255, 0, 255, 255, 0x21, 0x8c, 0xa5, 255, 0x84, 0xce, 0x08, 255,
+			255, 0, 255, 255, 255, 255, 255, 255, 255, 0, 255, 255,
+		}},
+	}
+	for i, test := range tests {
+		img, err := test.sgImage.Decode(DecodeOptions{DebugTransparent: &magenta})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(img.Pix, test.want) {
+			t.Errorf("Image %d: got %v, want %v", i, img.Pix, test.want)
+		}
+	}
+}
+
+func TestLabel(t *testing.T) {
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Length: 2, Width: 1, Height: 1}, {Length: 2, Width: 1, Height: 1, BitmapId: 9}}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("Plateau.bmp", 1, 2)}, images, plainData(0x7fff))
+
+	if label := sgFile.GetBitmap(0).Image(1).Label(); label != "plateau #1" {
+		t.Errorf("Got label %q, want %q", label, "plateau #1")
+	}
+	if label := sgFile.OrphanImages()[0].Label(); label != "image 3" {
+		t.Errorf("Got label %q for an orphan, want %q", label, "image 3")
+	}
+}
+
+func TestTransparencyBitmapIgnoresAlpha(t *testing.T) {
+	// Only the third pixel is keyed out, the alpha of the others is ignored
+	mask, err := alphaFixture(t).GetBitmap(0).Image(0).TransparencyBitmap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{255, 255, 0, 255}; !bytes.Equal(mask.Pix, want) {
+		t.Errorf("Got mask %v, want %v", mask.Pix, want)
+	}
+}
+
+// Loads an isometric image of the given size whose footprint takes all of
+// its data: the first large tile worth of data is red and the rest blue
+func isometricFixture(t *testing.T, width, height, length int, size uint8) *SgImage {
+	t.Helper()
+	data := make([]byte, 0, length)
+	for len(data) < length {
+		c := uint16(0x001f)
+		if len(data) < ISOMETRIC_LARGE_TILE_BYTES {
+			c = 0x7c00
+		}
+		data = append(data, plainData(c)...)
+	}
+	record := SgImageRecord{
+		Length:             uint32(length),
+		UncompressedLength: uint32(length),
+		Width:              int16(width),
+		Height:             int16(height),
+		Type:               uint16(TypeIsometric),
+	}
+	record.Flags[3] = size
+	return loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, []SgImageRecord{record}, data).GetBitmap(0).Image(0)
+}
+
+func TestIsometricLargeTiles(t *testing.T) {
+	// A 2x2 footprint of large tiles can only be large tiles
+	for _, size := range []uint8{0, 2} {
+		img, err := isometricFixture(t, 158, 80, 4*ISOMETRIC_LARGE_TILE_BYTES, size).GetImage()
+		if err != nil {
+			t.Fatalf("Size %d: %v", size, err)
+		}
+		// The middle of the top tile
+		if got := img.RGBAAt(40+39, 19); got != (color.RGBA{255, 0, 0, 255}) {
+			t.Errorf("Size %d: got %v in the top tile, want red", size, got)
+		}
+	}
+}
+
+func TestIsometricAmbiguousFootprint(t *testing.T) {
+	// 238x120 pixels and 28800 bytes fit both a 4x4 footprint of regular
+	// tiles and a 3x3 footprint of large tiles. At 89,29 the regular second
+	// tile is still red while the large second tile is blue.
+	tests := []struct {
+		size uint8
+		want color.RGBA
+	}{
+		{0, color.RGBA{255, 0, 0, 255}},
+		{4, color.RGBA{255, 0, 0, 255}},
+		{3, color.RGBA{0, 0, 255, 255}},
+	}
+	for _, test := range tests {
+		img, err := isometricFixture(t, 238, 120, 16*ISOMETRIC_TILE_BYTES, test.size).GetImage()
+		if err != nil {
+			t.Fatalf("Size %d: %v", test.size, err)
+		}
+		if got := img.RGBAAt(89, 29); got != test.want {
+			t.Errorf("Size %d: got %v, want %v", test.size, got, test.want)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	images := []SgImageRecord{
+		{Length: 2, Width: 1, Height: 1},
+		{Length: 2, Width: 0, Height: 1},
+		{Length: 2, Width: 1, Height: -1},
+		{Width: 1, Height: 1},
+		{Length: 2, Width: 1, Height: 1, Type: 99},
+	}
+	bitmap := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 5)}, images, plainData(0x7fff)).GetBitmap(0)
+
+	if err := bitmap.Image(0).Valid(); err != nil {
+		t.Errorf("Got error %v for a valid image", err)
+	}
+	for i := 1; i < len(images); i++ {
+		if err := bitmap.Image(i).Valid(); err == nil {
+			t.Errorf("Image %d is valid, want an error", i)
+		}
+	}
+}
+
+func TestIsExternal(t *testing.T) {
+	external := SgImageRecord{Offset: 1, Length: 2, Width: 1, Height: 1}
+	external.Flags[0] = 1
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, external}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 2)}, images, plainData(0x7fff))
+
+	var internalIds, externalIds []int
+	for _, sgImage := range sgFile.Images() {
+		if sgImage.IsExternal() {
+			externalIds = append(externalIds, sgImage.ImageId())
+		} else {
+			internalIds = append(internalIds, sgImage.ImageId())
+		}
+	}
+	if !slices.Equal(internalIds, []int{1}) || !slices.Equal(externalIds, []int{2}) {
+		t.Errorf("Got internal %v and external %v, want [1] and [2]", internalIds, externalIds)
+	}
+}
+
+func TestIsometricWithoutFootprint(t *testing.T) {
+	// The overlay skips 3 pixels and draws a white one
+	data := append([]byte{255, 3, 1}, plainData(0x7fff)...)
+	images := []SgImageRecord{{Length: uint32(len(data)), Width: 10, Height: 2, Type: uint16(TypeIsometric)}}
+	sgImage := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, images, data).GetBitmap(0).Image(0)
+
+	img, err := sgImage.GetImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		want := color.RGBA{}
+		if i == 3 {
+			want = color.RGBA{255, 255, 255, 255}
+		}
+		if got := img.RGBAAt(i%10, i/10); got != want {
+			t.Errorf("Got pixel %d %v, want %v", i, got, want)
+		}
+	}
+}
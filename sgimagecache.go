@@ -0,0 +1,55 @@
+package sgreader
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+type cachedImage struct {
+	id  int
+	img *image.RGBA
+}
+
+// imageCache keeps the most recently decoded images of an sg file, keyed by
+// image id. It is safe for concurrent use.
+type imageCache struct {
+	mutex  sync.Mutex
+	max    int
+	order  *list.List // most recently used at the front
+	images map[int]*list.Element
+}
+
+func newImageCache(max int) *imageCache {
+	return &imageCache{
+		max:    max,
+		order:  list.New(),
+		images: make(map[int]*list.Element),
+	}
+}
+
+func (cache *imageCache) get(id int) (*image.RGBA, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, ok := cache.images[id]
+	if !ok {
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(*cachedImage).img, true
+}
+
+func (cache *imageCache) put(id int, img *image.RGBA) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if element, ok := cache.images[id]; ok {
+		element.Value.(*cachedImage).img = img
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.images[id] = cache.order.PushFront(&cachedImage{id: id, img: img})
+	for cache.order.Len() > cache.max {
+		oldest := cache.order.Remove(cache.order.Back()).(*cachedImage)
+		delete(cache.images, oldest.id)
+	}
+}
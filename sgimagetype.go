@@ -0,0 +1,57 @@
+package sgreader
+
+import (
+	"fmt"
+)
+
+// ImageType identifies how the data of an image is stored
+type ImageType uint16
+
+const (
+	// Uncompressed 555 pixels
+	TypePlain   ImageType = 0
+	TypePlain1  ImageType = 1
+	TypePlain10 ImageType = 10
+	TypePlain12 ImageType = 12
+	TypePlain13 ImageType = 13
+	// Isometric footprint tiles followed by a transparent overlay
+	TypeIsometric ImageType = 30
+	// Run-length encoded pixels with transparency
+	TypeSprite    ImageType = 256
+	TypeSprite257 ImageType = 257
+	TypeSprite276 ImageType = 276
+)
+
+// Name of the image type, or "unknown" along with the code
+func (imageType ImageType) String() string {
+	switch imageType {
+	case TypePlain:
+		return "plain"
+	case TypePlain1:
+		return "plain1"
+	case TypePlain10:
+		return "plain10"
+	case TypePlain12:
+		return "plain12"
+	case TypePlain13:
+		return "plain13"
+	case TypeIsometric:
+		return "isometric"
+	case TypeSprite:
+		return "sprite"
+	case TypeSprite257:
+		return "sprite257"
+	case TypeSprite276:
+		return "sprite276"
+	}
+	return fmt.Sprintf("unknown (%d)", uint16(imageType))
+}
+
+// Whether images of this type can be decoded
+func (imageType ImageType) Known() bool {
+	switch imageType {
+	case TypePlain, TypePlain1, TypePlain10, TypePlain12, TypePlain13, TypeIsometric, TypeSprite, TypeSprite257, TypeSprite276:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package sgreader
+
+import "testing"
+
+func TestImageTypeString(t *testing.T) {
+	tests := map[uint16]string{
+		0:   "plain",
+		1:   "plain1",
+		10:  "plain10",
+		12:  "plain12",
+		13:  "plain13",
+		30:  "isometric",
+		256: "sprite",
+		257: "sprite257",
+		276: "sprite276",
+		99:  "unknown (99)",
+	}
+	for code, want := range tests {
+		if got := ImageType(code).String(); got != want {
+			t.Errorf("Got %q for type %d, want %q", got, code, want)
+		}
+		if known := ImageType(code).Known(); known != (code != 99) {
+			t.Errorf("Got known %v for type %d", known, code)
+		}
+	}
+
+	if got := sampleFixture(t).GetBitmap(0).Image(1).Type(); got != TypeSprite {
+		t.Errorf("Got type %v, want %v", got, TypeSprite)
+	}
+}
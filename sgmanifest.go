@@ -0,0 +1,171 @@
+package sgreader
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// ManifestEntry describes a single image of the file
+type ManifestEntry struct {
+	Id       int    `json:"id"`
+	Bitmap   string `json:"bitmap"`
+	BitmapId int    `json:"bitmapId"`
+	Index    int    `json:"index"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Type     int    `json:"type"`
+	External bool   `json:"external"`
+}
+
+func newManifestEntry(sgImage *SgImage) ManifestEntry {
+	entry := ManifestEntry{
+		Id:       sgImage.imageId,
+		BitmapId: sgImage.BitmapId(),
+		Index:    sgImage.localIndex,
+		Width:    int(sgImage.workRecord.Width),
+		Height:   int(sgImage.workRecord.Height),
+		Type:     int(sgImage.workRecord.Type),
+		External: sgImage.IsExternal(),
+	}
+	if sgImage.parent != nil {
+		entry.Bitmap = sgImage.parent.BitmapName()
+	}
+	return entry
+}
+
+// Get the manifest entries of all images in file order
+func (sgFile *SgFile) Manifest() []ManifestEntry {
+	manifest := make([]ManifestEntry, 0, len(sgFile.images))
+	for _, sgImage := range sgFile.images {
+		manifest = append(manifest, newManifestEntry(sgImage))
+	}
+	return manifest
+}
+
+// Writes the manifest as a JSON array, encoding one entry at a time so that
+// files with many images don't need the whole manifest in memory
+func (sgFile *SgFile) WriteManifest(w io.Writer) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	for i, sgImage := range sgFile.images {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Encode(newManifestEntry(sgImage)); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
+
+// Sidecar holds the metadata of an image that is lost when it is exported to
+// a regular image format, to be stored next to the exported file
+type Sidecar struct {
+	Type     int    `json:"type"`
+	Offset   uint32 `json:"offset"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Inverted bool   `json:"inverted"`
+	Bitmap   string `json:"bitmap"`
+}
+
+// Get the sidecar metadata of the image
+func (sgImage *SgImage) Sidecar() Sidecar {
+	sidecar := Sidecar{
+		Type:     int(sgImage.workRecord.Type),
+		Offset:   sgImage.workRecord.Offset,
+		Width:    int(sgImage.workRecord.Width),
+		Height:   int(sgImage.workRecord.Height),
+		Inverted: sgImage.invert,
+	}
+	if sgImage.parent != nil {
+		sidecar.Bitmap = sgImage.parent.BitmapName()
+	}
+	return sidecar
+}
+
+// Writes the sidecar metadata of the image as JSON
+func (sgImage *SgImage) WriteSidecar(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sgImage.Sidecar())
+}
+
+// SpriteRow describes an image as written by WriteImages, for importers
+// that read a CSV listing of the exported files. XOffset and YOffset give
+// the position of the written image within the full image, which is always
+// 0 as images are written untrimmed.
+type SpriteRow struct {
+	Bitmap   string
+	Index    int
+	Filename string
+	Width    int
+	Height   int
+	Type     int
+	XOffset  int
+	YOffset  int
+}
+
+// Get a row for each image WriteImages writes with opts, in file order.
+// Filenames are relative to the output directory and use slashes.
+func (sgFile *SgFile) SpriteRows(opts WriteOptions) ([]SpriteRow, error) {
+	extension, err := formatExtension(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	names := sgFile.exportNames()
+	filter := sgFile.newExportFilter()
+	var rows []SpriteRow
+	for _, sgImage := range sgFile.images {
+		if opts.Limit > 0 && len(rows) == opts.Limit {
+			break
+		}
+		if filter.skipReason(sgImage) != "" {
+			continue
+		}
+		filename := exportFilename(names, sgImage, opts) + "." + extension
+		if opts.PerBitmapDir {
+			filename = names[sgImage.parent] + "/" + filename
+		}
+		rows = append(rows, SpriteRow{
+			Bitmap:   sgImage.parent.BitmapName(),
+			Index:    sgImage.localIndex,
+			Filename: filename,
+			Width:    int(sgImage.workRecord.Width),
+			Height:   int(sgImage.workRecord.Height),
+			Type:     int(sgImage.workRecord.Type),
+		})
+	}
+	return rows, nil
+}
+
+// Writes the rows of SpriteRows as CSV, starting with a header row
+func (sgFile *SgFile) WriteCSV(w io.Writer, opts WriteOptions) error {
+	rows, err := sgFile.SpriteRows(opts)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"bitmap", "index", "filename", "width", "height", "type", "x-offset", "y-offset"})
+	for _, row := range rows {
+		writer.Write([]string{
+			row.Bitmap,
+			strconv.Itoa(row.Index),
+			row.Filename,
+			strconv.Itoa(row.Width),
+			strconv.Itoa(row.Height),
+			strconv.Itoa(row.Type),
+			strconv.Itoa(row.XOffset),
+			strconv.Itoa(row.YOffset),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,58 @@
+package sgreader
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestWriteManifestMatchesManifest(t *testing.T) {
+	sgFile := sampleFixture(t)
+	var buf bytes.Buffer
+	if err := sgFile.WriteManifest(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var streamed []ManifestEntry
+	if err := json.Unmarshal(buf.Bytes(), &streamed); err != nil {
+		t.Fatalf("Manifest isn't valid JSON: %v", err)
+	}
+	if manifest := sgFile.Manifest(); !slices.Equal(streamed, manifest) {
+		t.Errorf("Got streamed manifest %+v, want %+v", streamed, manifest)
+	}
+	want := ManifestEntry{Id: 2, Bitmap: "sample", Index: 1, Width: 3, Height: 2, Type: int(TypeSprite)}
+	if len(streamed) != 2 || streamed[1] != want {
+		t.Errorf("Got entries %+v, want the second to be %+v", streamed, want)
+	}
+}
+
+func TestWriteSidecar(t *testing.T) {
+	images := []SgImageRecord{{Offset: 2, Length: 4, Width: 2, Height: 1, Type: uint16(TypePlain)}}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("Units.bmp", 1, 1)}, images, plainData(0, 0x7c00, 0x001f))
+
+	var buf bytes.Buffer
+	if err := sgFile.GetBitmap(0).Image(0).WriteSidecar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var sidecar Sidecar
+	if err := json.Unmarshal(buf.Bytes(), &sidecar); err != nil {
+		t.Fatalf("Sidecar isn't valid JSON: %v", err)
+	}
+	want := Sidecar{Type: int(TypePlain), Offset: 2, Width: 2, Height: 1, Bitmap: "units"}
+	if sidecar != want {
+		t.Errorf("Got sidecar %+v, want %+v", sidecar, want)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := sampleFixture(t).WriteCSV(&buf, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := "bitmap,index,filename,width,height,type,x-offset,y-offset\n" +
+		"sample,0,sample_00001.png,2,2,0,0,0\n" +
+		"sample,1,sample_00002.png,3,2,256,0,0\n"
+	if buf.String() != want {
+		t.Errorf("Got CSV\n%s\nwant\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,201 @@
+package sgreader
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+)
+
+const (
+	sheetCaptionHeight = 12
+	sheetFontSize      = 7
+)
+
+// SheetOptions controls the layout of a contact sheet. Zero values fall back
+// to an A4 page holding a 4x5 grid with a 36pt margin.
+type SheetOptions struct {
+	Columns    int
+	Rows       int
+	PageWidth  float64
+	PageHeight float64
+	Margin     float64
+}
+
+func (opts SheetOptions) withDefaults() SheetOptions {
+	if opts.Columns <= 0 {
+		opts.Columns = 4
+	}
+	if opts.Rows <= 0 {
+		opts.Rows = 5
+	}
+	if opts.PageWidth <= 0 {
+		opts.PageWidth = 595
+	}
+	if opts.PageHeight <= 0 {
+		opts.PageHeight = 842
+	}
+	if opts.Margin <= 0 {
+		opts.Margin = 36
+	}
+	return opts
+}
+
+// Writes a PDF to w showing every image of the file in a grid, captioned
+// with the bitmap name, image id and size. Images are decoded one page at a
+// time, and images that fail to decode are shown by their caption only.
+func (sgFile *SgFile) ContactSheet(w io.Writer, opts SheetOptions) error {
+	opts = opts.withDefaults()
+	pdf := newPdfWriter(w)
+	perPage := opts.Columns * opts.Rows
+	cellWidth := (opts.PageWidth - 2*opts.Margin) / float64(opts.Columns)
+	cellHeight := (opts.PageHeight - 2*opts.Margin) / float64(opts.Rows)
+	if cellWidth <= 0 || cellHeight <= sheetCaptionHeight {
+		return fmt.Errorf("Page too small for a %dx%d grid", opts.Columns, opts.Rows)
+	}
+
+	pdf.header()
+	catalog := pdf.reserve()
+	pages := pdf.reserve()
+	font := pdf.reserve()
+	pdf.object(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	pdf.object(font, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>")
+
+	var kids []string
+	for start := 0; start == 0 || start < len(sgFile.images); start += perPage {
+		end := start + perPage
+		if end > len(sgFile.images) {
+			end = len(sgFile.images)
+		}
+
+		var content bytes.Buffer
+		var xobjects []string
+		for i, sgImage := range sgFile.images[start:end] {
+			x := opts.Margin + float64(i%opts.Columns)*cellWidth
+			y := opts.PageHeight - opts.Margin - float64(i/opts.Columns+1)*cellHeight
+
+			if img, err := sgImage.GetImage(); err == nil {
+				name := fmt.Sprintf("Im%d", i)
+				xobjects = append(xobjects, fmt.Sprintf("/%s %d 0 R", name, pdf.image(img)))
+
+				bounds := img.Bounds()
+				scale := (cellWidth - 4) / float64(bounds.Dx())
+				if s := (cellHeight - sheetCaptionHeight - 4) / float64(bounds.Dy()); s < scale {
+					scale = s
+				}
+				if scale > 1 {
+					scale = 1
+				}
+				fmt.Fprintf(&content, "q %.2f 0 0 %.2f %.2f %.2f cm /%s Do Q\n",
+					float64(bounds.Dx())*scale, float64(bounds.Dy())*scale, x+2, y+sheetCaptionHeight, name)
+			}
+			fmt.Fprintf(&content, "BT /F1 %d Tf %.2f %.2f Td (%s) Tj ET\n",
+				sheetFontSize, x+2, y+3, pdfEscape(sheetCaption(sgImage)))
+		}
+
+		stream := pdf.stream("", content.Bytes())
+		page := pdf.reserve()
+		pdf.object(page, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Contents %d 0 R /Resources << /Font << /F1 %d 0 R >> /XObject << %s >> >> >>",
+			pages, opts.PageWidth, opts.PageHeight, stream, font, strings.Join(xobjects, " ")))
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+
+	pdf.object(pages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	pdf.trailer(catalog)
+	return pdf.err
+}
+
+func sheetCaption(sgImage *SgImage) string {
+	name := ""
+	if sgImage.parent != nil {
+		name = sgImage.parent.BitmapName()
+	}
+	return fmt.Sprintf("%s #%d %s", name, sgImage.imageId, sgImage.String())
+}
+
+func pdfEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(text)
+}
+
+// pdfWriter writes the minimal subset of PDF needed for a contact sheet,
+// keeping track of object offsets for the cross-reference table
+type pdfWriter struct {
+	w       io.Writer
+	offset  int
+	offsets []int
+	err     error
+}
+
+func newPdfWriter(w io.Writer) *pdfWriter {
+	return &pdfWriter{w: w, offsets: []int{0}}
+}
+
+func (pdf *pdfWriter) write(data []byte) {
+	if pdf.err != nil {
+		return
+	}
+	n, err := pdf.w.Write(data)
+	pdf.offset += n
+	pdf.err = err
+}
+
+func (pdf *pdfWriter) header() {
+	pdf.write([]byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"))
+}
+
+// Allocate an object number, the object itself can be written later
+func (pdf *pdfWriter) reserve() int {
+	pdf.offsets = append(pdf.offsets, 0)
+	return len(pdf.offsets) - 1
+}
+
+func (pdf *pdfWriter) object(id int, body string) {
+	pdf.offsets[id] = pdf.offset
+	pdf.write([]byte(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", id, body)))
+}
+
+func (pdf *pdfWriter) stream(dict string, data []byte) int {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(data)
+	zw.Close()
+
+	id := pdf.reserve()
+	pdf.offsets[id] = pdf.offset
+	pdf.write([]byte(fmt.Sprintf("%d 0 obj\n<< %s /Filter /FlateDecode /Length %d >>\nstream\n", id, dict, compressed.Len())))
+	pdf.write(compressed.Bytes())
+	pdf.write([]byte("\nendstream\nendobj\n"))
+	return id
+}
+
+// Write img as an RGB image XObject with its alpha channel as a soft mask
+func (pdf *pdfWriter) image(img *image.RGBA) int {
+	bounds := img.Bounds()
+	rgb := make([]byte, 0, bounds.Dx()*bounds.Dy()*3)
+	alpha := make([]byte, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.RGBAAt(x, y)).(color.NRGBA)
+			rgb = append(rgb, c.R, c.G, c.B)
+			alpha = append(alpha, c.A)
+		}
+	}
+
+	size := fmt.Sprintf("/Width %d /Height %d /BitsPerComponent 8", bounds.Dx(), bounds.Dy())
+	mask := pdf.stream("/Type /XObject /Subtype /Image /ColorSpace /DeviceGray "+size, alpha)
+	return pdf.stream(fmt.Sprintf("/Type /XObject /Subtype /Image /ColorSpace /DeviceRGB %s /SMask %d 0 R", size, mask), rgb)
+}
+
+func (pdf *pdfWriter) trailer(root int) {
+	xref := pdf.offset
+	var table bytes.Buffer
+	fmt.Fprintf(&table, "xref\n0 %d\n0000000000 65535 f \n", len(pdf.offsets))
+	for _, offset := range pdf.offsets[1:] {
+		fmt.Fprintf(&table, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&table, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(pdf.offsets), root, xref)
+	pdf.write(table.Bytes())
+}
@@ -0,0 +1,69 @@
+package sgreader
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestContactSheetImageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := alphaFixture(t).ContactSheet(&buf, SheetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The soft mask holds the alpha and the image the colors before the
+	// alpha was applied
+	alpha := pdfStream(t, buf.Bytes(), "/DeviceGray")
+	if want := []byte{0x84, 255, 0, 0x84}; !bytes.Equal(alpha, want) {
+		t.Errorf("Got soft mask %v, want %v", alpha, want)
+	}
+	rgb := pdfStream(t, buf.Bytes(), "/DeviceRGB")
+	want := []byte{255, 0, 0, 255, 255, 255, 0, 0, 0, 0, 0, 255}
+	if !bytes.Equal(rgb, want) {
+		t.Errorf("Got colors %v, want %v", rgb, want)
+	}
+}
+
+// Returns the decompressed data of the first stream of the PDF whose
+// dictionary contains marker
+func pdfStream(t *testing.T, pdf []byte, marker string) []byte {
+	t.Helper()
+	re := regexp.MustCompile(`<<[^>]*` + regexp.QuoteMeta(marker) + `[^>]*/Length (\d+) >>\nstream\n`)
+	match := re.FindSubmatchIndex(pdf)
+	if match == nil {
+		t.Fatalf("No stream with %s", marker)
+	}
+	length, _ := strconv.Atoi(string(pdf[match[2]:match[3]]))
+	zr, err := zlib.NewReader(bytes.NewReader(pdf[match[1] : match[1]+length]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestContactSheetPages(t *testing.T) {
+	var images []SgImageRecord
+	for i := 0; i < 5; i++ {
+		images = append(images, SgImageRecord{Length: 2, Width: 1, Height: 1})
+	}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 5)}, images, plainData(0x7fff))
+
+	var buf bytes.Buffer
+	if err := sgFile.ContactSheet(&buf, SheetOptions{Columns: 2, Rows: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("%PDF-")) {
+		t.Errorf("Sheet starts with %q, want a PDF header", buf.Bytes()[:8])
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("/Count 3 ")) {
+		t.Error("5 images 2 to a page don't take 3 pages")
+	}
+}
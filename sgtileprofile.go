@@ -0,0 +1,87 @@
+package sgreader
+
+import (
+	"fmt"
+	"sync"
+)
+
+// tileProfile describes the size of the tiles making up isometric
+// footprints. Tiles are laid out on a grid 2 pixels wider than the tile, so
+// a footprint of size x size tiles is size * (width + 2) - 2 pixels wide and
+// size * height pixels high.
+type tileProfile struct {
+	width  int
+	height int
+	bytes  int
+}
+
+var (
+	tileProfilesLock sync.RWMutex
+	// The game tiles come first so that they win over registered profiles
+	// matching the same footprints
+	tileProfiles = []tileProfile{
+		{ISOMETRIC_TILE_WIDTH, ISOMETRIC_TILE_HEIGHT, ISOMETRIC_TILE_BYTES},
+		{ISOMETRIC_LARGE_TILE_WIDTH, ISOMETRIC_LARGE_TILE_HEIGHT, ISOMETRIC_LARGE_TILE_BYTES},
+	}
+)
+
+// Register an additional isometric tile size, for modded assets whose
+// footprints don't use the regular (58x30) or large (78x40) tiles of the
+// game. Registered sizes are tried in order after the game sizes. The size
+// must be even and bytes must match the number of pixels of a tile of that
+// size, 2 bytes each.
+func RegisterTileProfile(width, height, bytes int) error {
+	if width <= 0 || height <= 0 || width%2 != 0 || height%2 != 0 {
+		return fmt.Errorf("Invalid tile size: %dx%d", width, height)
+	}
+	profile := tileProfile{width, height, bytes}
+	if expected := 2 * profile.pixelCount(); bytes != expected {
+		return fmt.Errorf("Tile of %dx%d takes %d bytes, not %d", width, height, expected, bytes)
+	}
+
+	tileProfilesLock.Lock()
+	defer tileProfilesLock.Unlock()
+	for _, existing := range tileProfiles {
+		if existing == profile {
+			return nil
+		}
+	}
+	tileProfiles = append(tileProfiles, profile)
+	return nil
+}
+
+// The number of pixels of a tile, as drawn by writeIsometricTile
+func (profile tileProfile) pixelCount() int {
+	count := 0
+	for y := 0; y < profile.height; y++ {
+		start := profile.height - 2*(y+1)
+		if y >= profile.height/2 {
+			start = 2*y - profile.height
+		}
+		if profile.width > 2*start {
+			count += profile.width - 2*start
+		}
+	}
+	return count
+}
+
+// Find the tile profile of a footprint width pixels wide. A non-zero size
+// is the number of tiles along each side of the footprint as stored in the
+// image record, otherwise the first profile the width is a multiple of wins.
+func findTileProfile(width, size int) (tileProfile, int, error) {
+	tileProfilesLock.RLock()
+	defer tileProfilesLock.RUnlock()
+	for _, profile := range tileProfiles {
+		step := profile.width + 2
+		if size != 0 && size*step-2 == width {
+			return profile, size, nil
+		}
+		if size == 0 && (width+2)%step == 0 {
+			return profile, (width + 2) / step, nil
+		}
+	}
+	if size == 0 {
+		return tileProfile{}, 0, fmt.Errorf("Unknown tile size (width %d)", width)
+	}
+	return tileProfile{}, 0, fmt.Errorf("Unknown tile size: %d (width %d, size %d)", (width+2)/size-2, width, size)
+}
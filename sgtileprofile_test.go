@@ -0,0 +1,46 @@
+package sgreader
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestRegisterTileProfile(t *testing.T) {
+	const width, height, bytes = 64, 32, 2176
+	// Profiles can't be unregistered, so the registry is restored afterwards
+	saved := append([]tileProfile(nil), tileProfiles...)
+	t.Cleanup(func() {
+		tileProfilesLock.Lock()
+		tileProfiles = saved
+		tileProfilesLock.Unlock()
+	})
+
+	pixels := make([]uint16, bytes/2)
+	for i := range pixels {
+		pixels[i] = 0x7fff
+	}
+	record := SgImageRecord{Length: bytes, UncompressedLength: bytes, Width: width, Height: height, Type: uint16(TypeIsometric)}
+	record.Flags[3] = 1
+	sgImage := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 1)}, []SgImageRecord{record}, plainData(pixels...)).GetBitmap(0).Image(0)
+
+	if _, err := sgImage.GetImage(); err == nil {
+		t.Fatal("Decoded a 64x32 tile before registering its size")
+	}
+	if err := RegisterTileProfile(width, height, bytes+2); err == nil {
+		t.Error("Registered a tile size with the wrong number of bytes")
+	}
+	if err := RegisterTileProfile(width, height, bytes); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := sgImage.GetImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.RGBAAt(width/2, height/2-1); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("Got %v in the middle of the tile, want white", got)
+	}
+	if got := img.RGBAAt(0, 0); got != (color.RGBA{}) {
+		t.Errorf("Got %v in the corner of the tile, want transparent", got)
+	}
+}
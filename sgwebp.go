@@ -0,0 +1,155 @@
+package sgreader
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+)
+
+const (
+	webpMaxDimension = 1 << 14
+	vp8lSignature    = 0x2f
+)
+
+// Writes the image as a WebP file to w. Only lossless encoding is
+// supported, fails when lossless is false.
+func (sgImage *SgImage) WriteWebP(w io.Writer, lossless bool) error {
+	if !lossless {
+		return errors.New("Lossy WebP encoding is not supported")
+	}
+	img, err := sgImage.GetImage()
+	if err != nil {
+		return err
+	}
+	return encodeWebP(w, img)
+}
+
+// Encodes img as a lossless WebP file. The encoder doesn't compress: every
+// channel of every pixel is written as an 8 bit literal, which keeps it
+// simple at the cost of files about the size of the raw pixels.
+func encodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > webpMaxDimension || height > webpMaxDimension {
+		return fmt.Errorf("Image size %dx%d can't be stored as WebP", width, height)
+	}
+
+	pixels := make([]color.NRGBA, 0, width*height)
+	alphaUsed := uint32(0)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A != 255 {
+				alphaUsed = 1
+			}
+			pixels = append(pixels, c)
+		}
+	}
+
+	bw := &bitWriter{}
+	bw.write(vp8lSignature, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	bw.write(alphaUsed, 1)
+	bw.write(0, 3) // version
+	bw.write(0, 1) // no transforms
+	bw.write(0, 1) // no color cache
+	bw.write(0, 1) // no meta prefix codes
+
+	// Green and the backward reference lengths, then red, blue and alpha
+	writeLiteralCode(bw, 256+24)
+	writeLiteralCode(bw, 256)
+	writeLiteralCode(bw, 256)
+	writeLiteralCode(bw, 256)
+	// The distance code is never used, a simple code with the single
+	// symbol 0 takes no bits per symbol
+	bw.write(1, 1)
+	bw.write(0, 1)
+	bw.write(0, 1)
+	bw.write(0, 1)
+
+	// With all 256 literals 8 bits long, the prefix code of a value is the
+	// value itself, written from its most significant bit
+	for _, c := range pixels {
+		bw.write(uint32(bits.Reverse8(c.G)), 8)
+		bw.write(uint32(bits.Reverse8(c.R)), 8)
+		bw.write(uint32(bits.Reverse8(c.B)), 8)
+		bw.write(uint32(bits.Reverse8(c.A)), 8)
+	}
+	data := bw.flush()
+
+	padding := len(data) % 2
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+8+len(data)+padding))
+	copy(header[8:], "WEBP")
+	copy(header[12:], "VP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if padding > 0 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
+
+// Writes a normal prefix code for an alphabet of size symbols, where the
+// first 256 symbols are 8 bits long and the rest are unused. The code
+// lengths are themselves coded with 1 bit codes for the lengths 0 and 8.
+func writeLiteralCode(bw *bitWriter, size int) {
+	bw.write(0, 1) // normal code
+	// Code length code lengths are stored in the order 17, 18, 0, 1, 2, 3,
+	// 4, 5, 16, 6, 7, 8, ..., so 12 of them are needed to reach length 8
+	bw.write(12-4, 4)
+	for i := 0; i < 12; i++ {
+		switch i {
+		case 2, 11: // lengths 0 and 8
+			bw.write(1, 3)
+		default:
+			bw.write(0, 3)
+		}
+	}
+	bw.write(0, 1) // code lengths for the whole alphabet follow
+	for symbol := 0; symbol < size; symbol++ {
+		if symbol < 256 {
+			bw.write(1, 1)
+		} else {
+			bw.write(0, 1)
+		}
+	}
+}
+
+// bitWriter packs values into bytes starting from the least significant
+// bit, as used by the VP8L bitstream
+type bitWriter struct {
+	data  []byte
+	value uint64
+	count uint
+}
+
+func (bw *bitWriter) write(value uint32, n uint) {
+	bw.value |= uint64(value) << bw.count
+	bw.count += n
+	for bw.count >= 8 {
+		bw.data = append(bw.data, byte(bw.value))
+		bw.value >>= 8
+		bw.count -= 8
+	}
+}
+
+func (bw *bitWriter) flush() []byte {
+	if bw.count > 0 {
+		bw.data = append(bw.data, byte(bw.value))
+		bw.value, bw.count = 0, 0
+	}
+	return bw.data
+}
@@ -0,0 +1,220 @@
+package sgreader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/color"
+	"testing"
+)
+
+func TestWriteWebPRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := alphaFixture(t).GetBitmap(0).Image(0).WriteWebP(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	width, height, pixels, err := decodeVP8L(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != 2 || height != 2 {
+		t.Fatalf("Got a %dx%d image, want 2x2", width, height)
+	}
+	want := []color.NRGBA{
+		{255, 0, 0, 0x84}, {255, 255, 255, 255},
+		{0, 0, 0, 0}, {0, 0, 255, 0x84},
+	}
+	for i := range want {
+		if pixels[i] != want[i] {
+			t.Errorf("Got pixel %d %v, want %v", i, pixels[i], want[i])
+		}
+	}
+}
+
+// Decodes a lossless WebP file made of literal pixels only, enough to read
+// back what encodeWebP writes without trusting its own view of the format.
+// Transforms, the color cache and backward references aren't supported.
+func decodeVP8L(data []byte) (int, int, []color.NRGBA, error) {
+	if len(data) < 20 || string(data[0:4]) != "RIFF" || string(data[8:16]) != "WEBPVP8L" {
+		return 0, 0, nil, errors.New("Not a lossless WebP file")
+	}
+	if int(binary.LittleEndian.Uint32(data[4:]))+8 != len(data) {
+		return 0, 0, nil, errors.New("RIFF size doesn't match the file")
+	}
+	chunkSize := int(binary.LittleEndian.Uint32(data[16:]))
+	if 20+chunkSize > len(data) {
+		return 0, 0, nil, errors.New("VP8L chunk truncated")
+	}
+	br := &bitReader{data: data[20 : 20+chunkSize]}
+	if br.read(8) != vp8lSignature {
+		return 0, 0, nil, errors.New("Bad VP8L signature")
+	}
+	width := int(br.read(14)) + 1
+	height := int(br.read(14)) + 1
+	br.read(1) // alpha hint
+	if br.read(3) != 0 {
+		return 0, 0, nil, errors.New("Unknown VP8L version")
+	}
+	if br.read(1) != 0 || br.read(1) != 0 || br.read(1) != 0 {
+		return 0, 0, nil, errors.New("Transforms, color cache and meta codes aren't supported")
+	}
+
+	var codes [5]*prefixCode
+	for i, size := range []int{256 + 24, 256, 256, 256, 40} {
+		code, err := readPrefixCode(br, size)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		codes[i] = code
+	}
+
+	pixels := make([]color.NRGBA, width*height)
+	for i := range pixels {
+		green := codes[0].decode(br)
+		if green >= 256 {
+			return 0, 0, nil, errors.New("Backward references aren't supported")
+		}
+		red := codes[1].decode(br)
+		blue := codes[2].decode(br)
+		alpha := codes[3].decode(br)
+		pixels[i] = color.NRGBA{uint8(red), uint8(green), uint8(blue), uint8(alpha)}
+	}
+	if br.err != nil {
+		return 0, 0, nil, br.err
+	}
+	return width, height, pixels, nil
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (br *bitReader) read(n int) uint32 {
+	var value uint32
+	for i := 0; i < n; i++ {
+		if br.pos >= 8*len(br.data) {
+			br.err = errors.New("VP8L data truncated")
+			return 0
+		}
+		value |= uint32(br.data[br.pos/8]>>(br.pos%8)&1) << i
+		br.pos++
+	}
+	return value
+}
+
+// prefixCode is a canonical prefix code, decoded a bit at a time
+type prefixCode struct {
+	lengths []int
+	// The only symbol of codes with a single symbol, which take no bits
+	single int
+}
+
+func newPrefixCode(lengths []int) (*prefixCode, error) {
+	used, last := 0, 0
+	for symbol, length := range lengths {
+		if length > 0 {
+			used++
+			last = symbol
+		}
+	}
+	switch used {
+	case 0:
+		return nil, errors.New("Empty prefix code")
+	case 1:
+		return &prefixCode{single: last}, nil
+	}
+	return &prefixCode{lengths: lengths, single: -1}, nil
+}
+
+func (code *prefixCode) decode(br *bitReader) int {
+	if code.single >= 0 {
+		return code.single
+	}
+	// Walk the canonical code: the codes of each length follow the codes
+	// of the shorter lengths, ordered by symbol
+	value, first := 0, 0
+	for length := 1; length <= 15; length++ {
+		value |= int(br.read(1))
+		count := 0
+		for _, l := range code.lengths {
+			if l == length {
+				count++
+			}
+		}
+		if value-first < count {
+			index := 0
+			for symbol, l := range code.lengths {
+				if l == length {
+					if index == value-first {
+						return symbol
+					}
+					index++
+				}
+			}
+		}
+		first = (first + count) << 1
+		value <<= 1
+	}
+	br.err = errors.New("Invalid prefix code")
+	return 0
+}
+
+func readPrefixCode(br *bitReader, size int) (*prefixCode, error) {
+	lengths := make([]int, size)
+	if br.read(1) == 1 {
+		// Simple code of one or two symbols
+		count := int(br.read(1)) + 1
+		symbol := int(br.read(1 + 7*int(br.read(1))))
+		lengths[symbol] = 1
+		if count == 2 {
+			lengths[br.read(8)] = 1
+		}
+		return newPrefixCode(lengths)
+	}
+
+	order := []int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	lengthLengths := make([]int, 19)
+	count := 4 + int(br.read(4))
+	for i := 0; i < count; i++ {
+		lengthLengths[order[i]] = int(br.read(3))
+	}
+	lengthCode, err := newPrefixCode(lengthLengths)
+	if err != nil {
+		return nil, err
+	}
+
+	maxSymbol := size
+	if br.read(1) == 1 {
+		maxSymbol = 2 + int(br.read(2+2*int(br.read(3))))
+	}
+	previous := 8
+	for symbol := 0; symbol < size && maxSymbol > 0; maxSymbol-- {
+		c := lengthCode.decode(br)
+		repeat, value := 1, c
+		switch c {
+		case 16:
+			repeat, value = 3+int(br.read(2)), previous
+		case 17:
+			repeat, value = 3+int(br.read(3)), 0
+		case 18:
+			repeat, value = 11+int(br.read(7)), 0
+		default:
+			if c != 0 {
+				previous = c
+			}
+		}
+		if symbol+repeat > size {
+			return nil, errors.New("Code lengths overflow the alphabet")
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[symbol] = value
+			symbol++
+		}
+	}
+	if br.err != nil {
+		return nil, br.err
+	}
+	return newPrefixCode(lengths)
+}
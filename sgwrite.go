@@ -0,0 +1,397 @@
+package sgreader
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WriteOptions controls how WriteImages writes the images of a file
+type WriteOptions struct {
+	// Number of images decoded and written at the same time, defaults to the
+	// number of CPUs
+	Concurrency int
+	// Format of the written images, "png" (the default), "jpeg" or "webp"
+	Format string
+	// Write the images of each bitmap into their own subdirectory
+	PerBitmapDir bool
+	// Stop after the first Limit images with data, to sample large files. A
+	// limit of 0 or less writes every image.
+	Limit int
+	// Number the images of each bitmap from 0 instead of 1
+	ZeroBasedIndex bool
+	// Minimum number of digits of the image number, padded with zeroes.
+	// Defaults to 5.
+	IndexWidth int
+}
+
+// ImageStats holds the measurements taken while writing a single image
+type ImageStats struct {
+	Ref ImageRef
+	// Time taken to decode the image, excluding encoding and writing
+	DecodeTime time.Duration
+	// Number of bytes written to the output file
+	Size int64
+}
+
+// ExtractStats holds the measurements of every image written by a
+// WriteImages call, in file order
+type ExtractStats struct {
+	Images []ImageStats
+}
+
+// Get the measurements of the images written by the last WriteImages call.
+// Images that failed to be written aren't included.
+func (sgFile *SgFile) LastStats() ExtractStats {
+	return sgFile.lastStats
+}
+
+// SkipRecord tells why WriteImages didn't write an image
+type SkipRecord struct {
+	Ref    ImageRef
+	Reason string
+}
+
+// Get the images skipped by the last WriteImages call, in file order
+func (sgFile *SgFile) SkippedImages() []SkipRecord {
+	return sgFile.skipped
+}
+
+// MultiError holds the errors of every image that failed in a batch
+// operation, in file order. errors.Is and errors.As look through all of them.
+type MultiError struct {
+	Errors []error
+}
+
+// Returns a *MultiError holding the non-nil errors of errs, or nil if there
+// are none
+func newMultiError(errs []error) error {
+	var multi MultiError
+	for _, err := range errs {
+		if err != nil {
+			multi.Errors = append(multi.Errors, err)
+		}
+	}
+	if len(multi.Errors) == 0 {
+		return nil
+	}
+	return &multi
+}
+
+func (multi *MultiError) Error() string {
+	if len(multi.Errors) == 1 {
+		return multi.Errors[0].Error()
+	}
+	messages := make([]string, len(multi.Errors))
+	for i, err := range multi.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d images failed:\n%s", len(multi.Errors), strings.Join(messages, "\n"))
+}
+
+func (multi *MultiError) Unwrap() []error {
+	return multi.Errors
+}
+
+// Get the file name, without extension, that WriteImages uses with the
+// default numbering for each image of the file that has a bitmap
+func (sgFile *SgFile) ExportPlan() map[ImageRef]string {
+	names := sgFile.exportNames()
+	plan := make(map[ImageRef]string, len(sgFile.images))
+	for _, sgImage := range sgFile.images {
+		if sgImage.parent != nil {
+			plan[sgImage.Ref()] = exportFilename(names, sgImage, WriteOptions{})
+		}
+	}
+	return plan
+}
+
+// Get the names under which the bitmaps are exported. Bitmaps sharing the
+// name of an earlier bitmap get a _2, _3, ... suffix so that no two bitmaps
+// write to the same files.
+func (sgFile *SgFile) exportNames() map[*SgBitmap]string {
+	names := make(map[*SgBitmap]string, len(sgFile.bitmaps))
+	used := make(map[string]bool)
+	for _, bitmap := range sgFile.bitmaps {
+		name := bitmap.dirName()
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s_%d", bitmap.dirName(), n)
+		}
+		used[strings.ToLower(name)] = true
+		names[bitmap] = name
+	}
+	return names
+}
+
+func exportFilename(names map[*SgBitmap]string, sgImage *SgImage, opts WriteOptions) string {
+	index := sgImage.localIndex + 1
+	if opts.ZeroBasedIndex {
+		index = sgImage.localIndex
+	}
+	width := opts.IndexWidth
+	if width == 0 {
+		width = 5
+	}
+	return fmt.Sprintf("%s_%0*d", names[sgImage.parent], width, index)
+}
+
+// Decodes every image of the file and writes it to dir as
+// <bitmap>_<index>.<format>, where index starts at 1 within each bitmap
+// unless opts says otherwise and bitmaps sharing a name are told apart as
+// described by ExportPlan. Images are decoded, encoded and written by a pool
+// of workers that each read the data files independently. Placeholder images
+// without data, images of unsupported types, images without a bitmap and
+// images whose data file can't be opened are skipped and listed by
+// SkippedImages. All failures are returned together as a *MultiError rather
+// than stopping at the first.
+func (sgFile *SgFile) WriteImages(dir string, opts WriteOptions) error {
+	extension, err := formatExtension(opts.Format)
+	if err != nil {
+		return err
+	}
+	if opts.IndexWidth < 0 {
+		return fmt.Errorf("Invalid index width: %d", opts.IndexWidth)
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	// Create all directories up front so the workers only write files
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	names := sgFile.exportNames()
+	dirs := make(map[*SgBitmap]string)
+	for _, bitmap := range sgFile.bitmaps {
+		dirs[bitmap] = dir
+		if opts.PerBitmapDir {
+			dirs[bitmap] = filepath.Join(dir, names[bitmap])
+			if err := os.MkdirAll(dirs[bitmap], 0755); err != nil {
+				return err
+			}
+		}
+	}
+
+	jobs := make(chan int)
+	errs := make([]error, len(sgFile.images))
+	stats := make([]*ImageStats, len(sgFile.images))
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readers := sgFile.newDataReaders(concurrency)
+			defer readers.close()
+			for i := range jobs {
+				sgImage := sgFile.images[i]
+				filename := exportFilename(names, sgImage, opts) + "." + extension
+				imageStats, err := sgImage.writeFile(filepath.Join(dirs[sgImage.parent], filename), readers, opts.Format)
+				if err != nil {
+					errs[i] = fmt.Errorf("Image %d (%s): %w", sgImage.imageId, filename, err)
+					continue
+				}
+				stats[i] = &imageStats
+			}
+		}()
+	}
+
+	sgFile.skipped = nil
+	filter := sgFile.newExportFilter()
+	queued := 0
+	for i, sgImage := range sgFile.images {
+		if opts.Limit > 0 && queued == opts.Limit {
+			break
+		}
+		if reason := filter.skipReason(sgImage); reason != "" {
+			sgFile.skipped = append(sgFile.skipped, SkipRecord{sgImage.Ref(), reason})
+			continue
+		}
+		jobs <- i
+		queued++
+	}
+	close(jobs)
+	wg.Wait()
+
+	sgFile.lastStats = ExtractStats{}
+	for _, imageStats := range stats {
+		if imageStats != nil {
+			sgFile.lastStats.Images = append(sgFile.lastStats.Images, *imageStats)
+		}
+	}
+	return newMultiError(errs)
+}
+
+// exportFilter decides which images are exported, so that WriteImages,
+// SpriteRows and WriteZip leave out the same images. Whether each data file
+// can be opened is only checked once.
+type exportFilter struct {
+	source  DataSource
+	missing map[string]error
+}
+
+func (sgFile *SgFile) newExportFilter() *exportFilter {
+	return &exportFilter{source: sgFile.dataSource, missing: make(map[string]error)}
+}
+
+// Returns why the image isn't exported, or "" if it is
+func (filter *exportFilter) skipReason(sgImage *SgImage) string {
+	if sgImage.parent == nil {
+		return "No parent bitmap"
+	}
+	if err := sgImage.Valid(); err != nil {
+		return err.Error()
+	}
+
+	name := sgImage.parent.find555File(sgImage.IsExternal())
+	err, checked := filter.missing[name]
+	if !checked {
+		var reader io.ReaderAt
+		reader, _, err = filter.source.Open(name)
+		if closer, ok := reader.(io.Closer); ok && err == nil {
+			closer.Close()
+		}
+		filter.missing[name] = err
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func (sgImage *SgImage) writeFile(path string, readers *dataReaders, format string) (ImageStats, error) {
+	stats := ImageStats{Ref: sgImage.Ref()}
+	start := time.Now()
+	img, err := sgImage.decodeWith(readers, DecodeOptions{})
+	if err != nil {
+		return stats, err
+	}
+	stats.DecodeTime = time.Since(start)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return stats, err
+	}
+	counter := &countingWriter{w: file}
+	err = encodeImage(counter, img, format)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	stats.Size = counter.n
+	return stats, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func formatExtension(format string) (string, error) {
+	switch format {
+	case "", "png":
+		return "png", nil
+	case "jpeg", "jpg":
+		return "jpg", nil
+	case "webp":
+		return "webp", nil
+	}
+	return "", fmt.Errorf("Unknown image format: %s", format)
+}
+
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "", "png":
+		return png.Encode(w, img)
+	case "jpeg", "jpg":
+		return jpeg.Encode(w, img, nil)
+	case "webp":
+		return encodeWebP(w, img)
+	}
+	return fmt.Errorf("Unknown image format: %s", format)
+}
+
+// Get the image encoded in format as a base64 data URI, such as
+// data:image/png;base64,..., to embed it in HTML or JSON
+func (sgImage *SgImage) DataURI(format string) (string, error) {
+	extension, err := formatExtension(format)
+	if err != nil {
+		return "", err
+	}
+	img, err := sgImage.GetImage()
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, format); err != nil {
+		return "", err
+	}
+	mediaType := "image/" + extension
+	if extension == "jpg" {
+		mediaType = "image/jpeg"
+	}
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Writes the images of the bitmap as a zip archive to w, encoded in format
+// and named by their index starting at 1 (00001.png, 00002.png, ...), along
+// with a manifest.json describing every image of the bitmap. The images
+// WriteImages would skip are left out of the archive.
+func (sgBitmap *SgBitmap) WriteZip(w io.Writer, format string) error {
+	extension, err := formatExtension(format)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	manifest := make([]ManifestEntry, 0, len(sgBitmap.images))
+	filter := sgBitmap.sgFile.newExportFilter()
+	for _, sgImage := range sgBitmap.images {
+		manifest = append(manifest, newManifestEntry(sgImage))
+		if filter.skipReason(sgImage) != "" {
+			continue
+		}
+
+		img, err := sgImage.GetImage()
+		if err != nil {
+			return fmt.Errorf("Image %d: %w", sgImage.imageId, err)
+		}
+		entry, err := archive.Create(fmt.Sprintf("%05d.%s", sgImage.localIndex+1, extension))
+		if err != nil {
+			return err
+		}
+		if err := encodeImage(entry, img, format); err != nil {
+			return err
+		}
+	}
+
+	entry, err := archive.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+	return archive.Close()
+}
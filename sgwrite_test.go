@@ -0,0 +1,339 @@
+package sgreader
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// The export fixture holds, in bitmap "ext", a valid image, an image of an
+// unknown type, an external image whose data file is missing, a placeholder
+// without data and another valid image
+func exportFixture(t *testing.T) *SgFile {
+	t.Helper()
+	external := SgImageRecord{Offset: 1, Length: 2, Width: 1, Height: 1}
+	external.Flags[0] = 1
+	images := []SgImageRecord{
+		{Length: 2, Width: 1, Height: 1},
+		{Length: 2, Width: 1, Height: 1, Type: 99},
+		external,
+		{Width: 1, Height: 1},
+		{Offset: 2, Length: 2, Width: 1, Height: 1},
+	}
+	return loadFixture(t, []SgBitmapRecord{bitmapRecord("ext.bmp", 1, 5)}, images, plainData(0x7c00, 0x001f))
+}
+
+func TestExportsSkipTheSameImages(t *testing.T) {
+	for _, limit := range []int{0, 2} {
+		sgFile := exportFixture(t)
+		dir := t.TempDir()
+		opts := WriteOptions{Limit: limit}
+		if err := sgFile.WriteImages(dir, opts); err != nil {
+			t.Fatal(err)
+		}
+		var written []string
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			written = append(written, entry.Name())
+		}
+		want := []string{"ext_00001.png", "ext_00005.png"}
+		if !slices.Equal(written, want) {
+			t.Errorf("Limit %d: wrote %v, want %v", limit, written, want)
+		}
+
+		var skipped []int
+		for _, record := range sgFile.SkippedImages() {
+			skipped = append(skipped, record.Ref.Index)
+		}
+		if !slices.Equal(skipped, []int{1, 2, 3}) {
+			t.Errorf("Limit %d: skipped %v, want images 1, 2 and 3", limit, skipped)
+		}
+
+		rows, err := sgFile.SpriteRows(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var listed []string
+		for _, row := range rows {
+			listed = append(listed, row.Filename)
+		}
+		if !slices.Equal(listed, want) {
+			t.Errorf("Limit %d: listed %v, want %v", limit, listed, want)
+		}
+	}
+}
+
+func TestWriteZipSkipsLikeWriteImages(t *testing.T) {
+	var buf bytes.Buffer
+	if err := exportFixture(t).GetBitmap(0).WriteZip(&buf, "png"); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, filepath.Base(file.Name))
+	}
+	if want := []string{"00001.png", "00005.png", "manifest.json"}; !slices.Equal(names, want) {
+		t.Errorf("Got entries %v, want %v", names, want)
+	}
+}
+
+func TestWriteZip(t *testing.T) {
+	bitmap := sampleFixture(t).GetBitmap(0)
+	var buf bytes.Buffer
+	if err := bitmap.WriteZip(&buf, "png"); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images := 0
+	for _, file := range archive.File {
+		if file.Name == "manifest.json" {
+			continue
+		}
+		images++
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = png.Decode(r)
+		r.Close()
+		if err != nil {
+			t.Errorf("%s isn't a valid PNG: %v", file.Name, err)
+		}
+	}
+	if images != bitmap.ImageCount() {
+		t.Errorf("Got %d images in the archive, want %d", images, bitmap.ImageCount())
+	}
+}
+
+func TestLastStats(t *testing.T) {
+	sgFile := sampleFixture(t)
+	dir := t.TempDir()
+	if err := sgFile.WriteImages(dir, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := sgFile.LastStats().Images
+	want := []ImageRef{{Bitmap: "sample", Index: 0}, {Bitmap: "sample", Index: 1}}
+	if len(stats) != len(want) {
+		t.Fatalf("Got stats for %d images, want %d", len(stats), len(want))
+	}
+	for i, imageStats := range stats {
+		if imageStats.Ref != want[i] {
+			t.Errorf("Got stats of %+v, want %+v", imageStats.Ref, want[i])
+		}
+		fi, err := os.Stat(filepath.Join(dir, fmt.Sprintf("sample_%05d.png", i+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imageStats.Size != fi.Size() {
+			t.Errorf("Got size %d for image %d, want the %d bytes written", imageStats.Size, i, fi.Size())
+		}
+		if imageStats.DecodeTime < 0 {
+			t.Errorf("Got decode time %v for image %d", imageStats.DecodeTime, i)
+		}
+	}
+}
+
+func TestDataURI(t *testing.T) {
+	uri, err := sampleFixture(t).GetBitmap(0).Image(0).DataURI("png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "data:image/png;base64,"
+	if !strings.HasPrefix(uri, prefix) {
+		t.Fatalf("Got %.30q, want it to start with %q", uri, prefix)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.RGBAModel.Convert(img.At(1, 0)); got != (color.RGBA{0, 255, 0, 255}) {
+		t.Errorf("Got pixel %v, want green", got)
+	}
+}
+
+func TestWriteImagesReturnsEveryFailure(t *testing.T) {
+	images := []SgImageRecord{
+		{Length: 4, Width: 1, Height: 1},
+		{Length: 2, Width: 1, Height: 1},
+		{Offset: 100, Length: 2, Width: 1, Height: 1},
+	}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 3)}, images, plainData(0x7fff, 0x7fff))
+
+	err := sgFile.WriteImages(t.TempDir(), WriteOptions{})
+	var multi *MultiError
+	if !errors.As(err, &multi) {
+		t.Fatalf("Got error %v, want a *MultiError", err)
+	}
+	if len(multi.Errors) != 2 {
+		t.Errorf("Got %d errors, want 2: %v", len(multi.Errors), err)
+	}
+	if !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Errorf("Got error %v, want it to include ErrOffsetOutOfRange", err)
+	}
+	if !strings.Contains(err.Error(), "Image 1 ") {
+		t.Errorf("Got error %v, want it to include the failure of image 1", err)
+	}
+}
+
+func TestExportPlanSeparatesDuplicateNames(t *testing.T) {
+	bitmaps := []SgBitmapRecord{bitmapRecord("House.bmp", 1, 1), bitmapRecord("house.bmp", 2, 2)}
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Length: 2, Width: 1, Height: 1, BitmapId: 1}}
+	sgFile := loadFixture(t, bitmaps, images, plainData(0x7fff))
+
+	plan := sgFile.ExportPlan()
+	want := map[ImageRef]string{
+		{Bitmap: "house", BitmapId: 0, Index: 0}: "house_00001",
+		{Bitmap: "house", BitmapId: 1, Index: 0}: "house_2_00001",
+	}
+	if !maps.Equal(plan, want) {
+		t.Errorf("Got plan %v, want %v", plan, want)
+	}
+
+	dir := t.TempDir()
+	if err := sgFile.WriteImages(dir, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Wrote %d files, want 2", len(entries))
+	}
+}
+
+func TestWriteImagesLimit(t *testing.T) {
+	var images []SgImageRecord
+	for i := 0; i < 5; i++ {
+		images = append(images, SgImageRecord{Length: 2, Width: 1, Height: 1})
+	}
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 5)}, images, plainData(0x7fff))
+
+	dir := t.TempDir()
+	if err := sgFile.WriteImages(dir, WriteOptions{Limit: 3}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []string
+	for _, entry := range entries {
+		written = append(written, entry.Name())
+	}
+	if want := []string{"a_00001.png", "a_00002.png", "a_00003.png"}; !slices.Equal(written, want) {
+		t.Errorf("Wrote %v, want %v", written, want)
+	}
+}
+
+func TestWriteImagesNumbering(t *testing.T) {
+	images := []SgImageRecord{{Length: 2, Width: 1, Height: 1}, {Length: 2, Width: 1, Height: 1}}
+	tests := []struct {
+		opts WriteOptions
+		want []string
+	}{
+		{WriteOptions{}, []string{"a_00001.png", "a_00002.png"}},
+		{WriteOptions{ZeroBasedIndex: true}, []string{"a_00000.png", "a_00001.png"}},
+		{WriteOptions{ZeroBasedIndex: true, IndexWidth: 2}, []string{"a_00.png", "a_01.png"}},
+	}
+	for _, test := range tests {
+		sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 2)}, images, plainData(0x7fff))
+		dir := t.TempDir()
+		if err := sgFile.WriteImages(dir, test.opts); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var written []string
+		for _, entry := range entries {
+			written = append(written, entry.Name())
+		}
+		if !slices.Equal(written, test.want) {
+			t.Errorf("%+v: wrote %v, want %v", test.opts, written, test.want)
+		}
+	}
+
+	sgFile := loadFixture(t, []SgBitmapRecord{bitmapRecord("a.bmp", 1, 2)}, images, plainData(0x7fff))
+	if err := sgFile.WriteImages(t.TempDir(), WriteOptions{IndexWidth: -1}); err == nil {
+		t.Error("Wrote images with a negative index width")
+	}
+}
+
+func TestWriteImagesConcurrencyMatchesGetImage(t *testing.T) {
+	var sizes []int
+	for i := 0; i < 24; i++ {
+		sizes = append(sizes, 1+i%7*3)
+	}
+	for _, concurrency := range []int{1, 4} {
+		sgFile := manyFixture(t, sizes)
+		dir := t.TempDir()
+		if err := sgFile.WriteImages(dir, WriteOptions{Concurrency: concurrency}); err != nil {
+			t.Fatal(err)
+		}
+
+		plan := sgFile.ExportPlan()
+		for _, sgImage := range sgFile.Images() {
+			want := mustDecode(t, sgImage)
+			filename := filepath.Join(dir, plan[sgImage.Ref()]+".png")
+			file, err := os.Open(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(file)
+			file.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			written := image.NewRGBA(img.Bounds())
+			draw.Draw(written, written.Bounds(), img, img.Bounds().Min, draw.Src)
+			if !bytes.Equal(written.Pix, want) {
+				t.Errorf("Concurrency %d: %s differs from GetImage", concurrency, filename)
+			}
+		}
+	}
+}
+
+func BenchmarkWriteImages(b *testing.B) {
+	sizes := make([]int, 64)
+	for i := range sizes {
+		sizes[i] = 64
+	}
+	sgFile := manyFixture(b, sizes)
+	dir := b.TempDir()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sgFile.WriteImages(dir, WriteOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}